@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/guillotjulien/mongo-profiler/internal/collector"
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+	"github.com/guillotjulien/mongo-profiler/internal/mongo"
+	"github.com/guillotjulien/mongo-profiler/internal/redact"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// collectCommand tails system.profile of the listened installation and stores slow ops in the internal one.
+func collectCommand(args []string) {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	listenedURI := flags.String("listened", "", "Connection string URI of listened MongoDB installation")
+	internalURI := flags.String("internal", defaultInternalURI, "Connection string URI of internal MongoDB installation")
+	verbose := flags.Bool("v", false, "Make the profiler more talkative")
+	slowThresholdMS := flags.Uint64("slowThresholdMS", 100, "Define the minimum query duration in milliseconds after which a query will be logged")
+	profilerLevel := flags.Uint("profilerLevel", 1, "Set MongoDB profiler level. 1 only logs slow queries, 2 logs all queries")
+	workers := flags.Int("workers", 4, "Number of workers handling profile entries")
+	queueSize := flags.Int("queueSize", 1000, "Maximum number of profile entries waiting for a worker")
+	queuePolicy := flags.String("queuePolicy", string(collector.QueueBlock), "What to do with new profile entries when the queue is full: block, drop-oldest or drop-newest")
+	batchSize := flags.Int("batchSize", constant.PROFILER_WRITER_BATCH_SIZE, "Number of records inserted at once in the internal MongoDB installation")
+	flushInterval := flags.Duration("flushInterval", constant.PROFILER_WRITER_FLUSH_INTERVAL, "Maximum time a record is buffered before being inserted in the internal MongoDB installation")
+	databases := flags.String("databases", "", "Comma separated list of databases to profile, or * for every non-system database (default: database of the listened URI)")
+	redactMode := flags.String("redact", string(redact.ModeOff), "How literals of stored examples are redacted: off, hash, placeholder or allowlist")
+	redactRules := flags.String("redactRules", "", "Per namespace redaction, e.g. \"app.users=allowlist:status,country;logs.*=off\" (first match wins, -redact applies otherwise)")
+	redactKey := flags.String("redactKey", os.Getenv("PROFILER_REDACT_KEY"), "Secret keying the hashes of the hash redaction mode, so that they match across runs (default: $PROFILER_REDACT_KEY, random key otherwise)")
+	allMembers := flags.Bool("allMembers", false, "Profile every member of the replica set (e.g. to catch reads sent to secondaries) instead of the primary only")
+	currentOpInterval := flags.Duration("currentOpInterval", 0, "Time between two $currentOp polls recording long-running operations, 0 disables polling (requires the inprog privilege)")
+	currentOpThreshold := flags.Duration("currentOpThreshold", constant.PROFILER_CURRENTOP_THRESHOLD, "Minimum running time of the operations recorded by the $currentOp poller")
+	indexStatsInterval := flags.Duration("indexStatsInterval", 0, "Time between two $indexStats snapshots of every collection (e.g. 1h), 0 disables snapshots")
+	killRules := flags.String("killRules", "", "Kill the running operations matching these rules, e.g. \"ns=app.*,collscan,after=30s;user=reporting@admin,after=10m\" (requires -currentOpInterval and the killop privilege)")
+	killAllowAppNames := flags.String("killAllowAppNames", "", "Comma separated list of applications whose operations are never killed")
+	killDryRun := flags.Bool("killDryRun", false, "Only log and audit the operations matching -killRules instead of killing them")
+
+	flags.Parse(args)
+
+	if *listenedURI == "" || *internalURI == "" {
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *verbose {
+		logger.VERBOSE_LOGS = true
+	}
+
+	policy, err := collector.ParseQueuePolicy(*queuePolicy)
+	if err != nil {
+		logger.Fatal("%v", err)
+	}
+
+	if *workers < 1 {
+		logger.Fatal("-workers must be at least 1")
+	}
+	if *queueSize < 0 {
+		logger.Fatal("-queueSize cannot be negative")
+	}
+	if *queueSize == 0 && policy == collector.QueueDropOldest { // There is never an older entry to drop
+		logger.Fatal("-queuePolicy=%s requires a -queueSize of at least 1", collector.QueueDropOldest)
+	}
+
+	if *flushInterval <= 0 {
+		logger.Fatal("-flushInterval must be greater than 0")
+	}
+	if *currentOpInterval < 0 || *indexStatsInterval < 0 {
+		logger.Fatal("-currentOpInterval and -indexStatsInterval cannot be negative (0 disables them)")
+	}
+
+	defaultRedactMode, err := redact.ParseMode(*redactMode)
+	if err != nil {
+		logger.Fatal("%v", err)
+	}
+
+	rules, err := redact.ParseRules(*redactRules)
+	if err != nil {
+		logger.Fatal("%v", err)
+	}
+
+	redactor := &redact.Redactor{Default: defaultRedactMode, Rules: rules, Key: []byte(*redactKey)}
+	if len(redactor.Key) == 0 {
+		redactor.Key = make([]byte, 32)
+		if _, err := rand.Read(redactor.Key); err != nil {
+			logger.Fatal("failed to generate redaction key: %v", err)
+		}
+		if redactor.Hashes() {
+			logger.Warn("no -redactKey given, hashes of redacted values won't match the ones of previous runs")
+		}
+	}
+
+	kills, err := collector.ParseKillRules(*killRules)
+	if err != nil {
+		logger.Fatal("%v", err)
+	}
+
+	if len(kills) > 0 && *currentOpInterval <= 0 {
+		logger.Fatal("-killRules requires -currentOpInterval")
+	}
+	for _, rule := range kills {
+		if rule.After < *currentOpThreshold { // The poller doesn't see the operation before
+			logger.Warn("kill rule %q only applies to operations running for longer than -currentOpThreshold (%v)", rule.Spec, *currentOpThreshold)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listenedClient, err := mongo.NewClient(ctx, *listenedURI)
+	if err != nil {
+		logger.Fatal("failed to instantiate listened client: %v", err)
+	}
+
+	internalClient, err := mongo.NewClient(ctx, *internalURI)
+	if err != nil {
+		logger.Fatal("failed to instantiate internal client: %v", err)
+	}
+
+	if listenedClient.Equal(internalClient) {
+		logger.Fatal("cannot use the same database for listened and internal MongoDB installation")
+	}
+
+	if err := internalClient.Connect(ctx); err != nil {
+		logger.Fatal("failed to connect to internal MongoDB installation: %v", err)
+	}
+
+	// Init internal store collections
+	if err := collector.InitSlowOpsRecordCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_SLOWOPS_COLLECTION, err)
+	}
+	if err := collector.InitSlowOpsExampleRecordCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_SLOWOPS_EXAMPLE_COLLECTION, err)
+	}
+	if err := collector.InitCheckpointCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_CHECKPOINT_COLLECTION, err)
+	}
+	if err := collector.InitCursorSummaryCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_CURSORS_COLLECTION, err)
+	}
+	if err := collector.InitRollupCollections(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize rollup collections in listened MongoDB installation: %v", err)
+	}
+	if err := collector.InitCurrentOpCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_CURRENTOPS_COLLECTION, err)
+	}
+	if err := collector.InitKillAuditCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_KILL_AUDIT_COLLECTION, err)
+	}
+	if err := collector.InitIndexStatsCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_INDEXSTATS_COLLECTION, err)
+	}
+	if err := collector.InitProfilerSettingsCollection(ctx, internalClient.GetDefaultDatabase()); err != nil {
+		logger.Fatal("failed to initialize %s collection in listened MongoDB installation: %v", constant.PROFILER_SETTINGS_COLLECTION, err)
+	}
+
+	c := collector.NewCollector(listenedClient, collector.CollectorOptions{
+		SlowThresholdMS:  *slowThresholdMS,
+		ProfilerLevel:    *profilerLevel,
+		AllMembers:       *allMembers,
+		Databases:        splitList(*databases),
+		Checkpoints:      collector.NewCheckpointStore(internalClient.GetDefaultDatabase()),
+		ProfilerSettings: collector.NewProfilerSettingsStore(internalClient.GetDefaultDatabase()),
+		Workers:          *workers,
+		QueueSize:        *queueSize,
+		QueuePolicy:      policy,
+	})
+
+	go metrics.Log(ctx, constant.METRICS_LOG_INTERVAL)
+
+	slowOpsWriter := mongo.NewBatchWriter(ctx, internalClient, constant.PROFILER_SLOWOPS_COLLECTION, *batchSize, *flushInterval)
+	slowOpsExampleWriter := mongo.NewBatchWriter(ctx, internalClient, constant.PROFILER_SLOWOPS_EXAMPLE_COLLECTION, *batchSize, *flushInterval)
+	cursors := collector.NewCursorTracker(ctx, internalClient.GetDefaultDatabase(), *flushInterval)
+	rollups := collector.NewRollups(ctx, internalClient.GetDefaultDatabase(), *flushInterval)
+	slowOpsWriter.OnInserted(func(doc bson.Raw) {
+		// Only roll up records stored for the first time, so that entries read again after a restart aren't counted twice
+		record := &collector.SlowOpsRecord{}
+		if err := bson.Unmarshal(doc, record); err != nil {
+			logger.Warn("failed to roll up slow ops record: %v", err)
+			return
+		}
+		rollups.Add(record)
+	})
+
+	var currentOps *collector.CurrentOpPoller
+	if *currentOpInterval > 0 {
+		var killer *collector.Killer
+		if len(kills) > 0 {
+			killer = collector.NewKiller(listenedClient, internalClient.GetDefaultDatabase(), collector.KillPolicy{
+				Rules:           kills,
+				AllowedAppNames: splitList(*killAllowAppNames),
+				DryRun:          *killDryRun,
+			})
+		}
+
+		currentOps = collector.NewCurrentOpPoller(ctx, listenedClient, internalClient.GetDefaultDatabase(), collector.CurrentOpOptions{
+			Interval:  *currentOpInterval,
+			Threshold: *currentOpThreshold,
+			Databases: splitList(*databases),
+			Redactor:  redactor,
+			Killer:    killer,
+		})
+	}
+
+	var indexStats *collector.IndexStatsSnapshotter
+	if *indexStatsInterval > 0 {
+		indexStats = collector.NewIndexStatsSnapshotter(ctx, listenedClient, internalClient.GetDefaultDatabase(), collector.IndexStatsOptions{
+			Interval:  *indexStatsInterval,
+			Databases: splitList(*databases),
+		})
+	}
+
+	teardownComplete := make(chan bool, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		<-signals // Wait for signal
+
+		logger.Info("received shutdown signal. Stopping collector")
+
+		if currentOps != nil {
+			currentOps.Close(ctx)
+		}
+		if indexStats != nil {
+			indexStats.Close()
+		}
+
+		if err := c.Stop(ctx); err != nil {
+			logger.Fatal("failed to stop collector: %v", err)
+		}
+
+		// Every queued entry was handled by now, persist what's still buffered
+		slowOpsWriter.Close(ctx)
+		slowOpsExampleWriter.Close(ctx)
+		cursors.Close(ctx)
+		rollups.Close(ctx)
+
+		if err := internalClient.Disconnect(ctx); err != nil {
+			logger.Fatal("failed to close connection with target MongoDB installation: %v", err)
+		}
+
+		cancel()
+
+		logger.Info("collector was successfully stopped")
+
+		teardownComplete <- true
+	}()
+
+	err = c.Start(ctx, func(ctx context.Context, source collector.Source, data bson.Raw) error {
+		if source.Host == "" {
+			source.Host = strings.Join(listenedClient.Connstr.Hosts, ",")
+		}
+
+		entry, err := collector.NewProfilerEntry(source, data)
+		if err != nil {
+			logger.Error("failed to read profiling entry: %v", err)
+			return err
+		}
+
+		logger.Info("received slow op entry for %s", entry.Collection)
+
+		cursors.Track(entry) // getMores inherit the queryHash of the op that opened their cursor
+		record := entry.ToSlowOpsRecord()
+		record.TryInsert(slowOpsWriter) // Rolled up once inserted
+
+		example, err := entry.ToSlowOpsExampleRecord(redactor)
+		if err != nil {
+			logger.Warn("%v", err) // Better no example than one leaking data
+			return nil
+		}
+		example.TryInsert(slowOpsExampleWriter)
+
+		return nil
+	})
+
+	if err != nil {
+		logger.Fatal("%v", err)
+	}
+
+	<-teardownComplete // wait for teardown
+
+	os.Exit(0)
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,259 @@
+// Package api serves the slow ops stored by the collector as JSON.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/report"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Server exposes:
+//   - GET /api/shapes: query shapes aggregated by shape + collection
+//   - GET /api/shapes/<queryHash>/examples: stored examples of a query shape
+//   - GET /api/shapes/<queryHash>/timeseries: count and durations of a query shape over time
+//   - GET /api/shapes/<queryHash>/plans: plans used by a query shape
+//   - GET /api/collscans: query shapes running without index
+//   - GET /api/top/<user|collection|plan>: breakdown of the slow ops
+//
+// Lists accept since, until (date or duration before now), collection, user, sort, limit and offset parameters.
+type Server struct {
+	db  *mongo.Database
+	mux *http.ServeMux
+}
+
+// Example is a stored example with its BSON fields as extended JSON.
+type Example struct {
+	QueryHash   string          `json:"queryHash"`
+	ShapeHash   string          `json:"shapeHash,omitempty"`
+	Collection  string          `json:"collection"`
+	PlanHash    string          `json:"planHash,omitempty"`
+	PlanSummary string          `json:"planSummary,omitempty"`
+	Shape       json.RawMessage `json:"shape,omitempty"`
+	Document    json.RawMessage `json:"document,omitempty"`
+}
+
+type page struct {
+	Items  interface{} `json:"items"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+var topReports = map[string]string{"user": "users", "collection": "collections", "plan": "plans"}
+
+func NewServer(db *mongo.Database) *Server {
+	s := &Server{}
+	s.db = db
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/api/shapes", s.shapes)
+	s.mux.HandleFunc("/api/shapes/", s.shape)
+	s.mux.HandleFunc("/api/collscans", s.collscans)
+	s.mux.HandleFunc("/api/top/", s.top)
+
+	return s
+}
+
+// Handle serves more routes, e.g. the web UI.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) shapes(w http.ResponseWriter, r *http.Request) {
+	s.report(w, r, "shapes")
+}
+
+func (s *Server) collscans(w http.ResponseWriter, r *http.Request) {
+	s.report(w, r, "collscan")
+}
+
+func (s *Server) top(w http.ResponseWriter, r *http.Request) {
+	name, ok := topReports[strings.TrimPrefix(r.URL.Path, "/api/top/")]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown breakdown, expected user, collection or plan"))
+		return
+	}
+
+	s.report(w, r, name)
+}
+
+// shape routes /api/shapes/<queryHash>/<examples|timeseries|plans>.
+func (s *Server) shape(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/shapes/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	queryHash := parts[0]
+
+	switch parts[1] {
+	case "examples":
+		s.examples(w, r, queryHash)
+	case "timeseries":
+		s.timeseries(w, r, queryHash)
+	case "plans":
+		s.plans(w, r, queryHash)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (s *Server) report(w http.ResponseWriter, r *http.Request, name string) {
+	opts, err := options(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := report.Run(r.Context(), s.db, name, opts)
+	if err != nil {
+		if errors.Is(err, report.ErrInvalidOptions) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		logger.Error("failed to run report %s: %v", name, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page{Items: result.Objects(), Limit: opts.Limit, Offset: opts.Offset})
+}
+
+func (s *Server) examples(w http.ResponseWriter, r *http.Request, queryHash string) {
+	records, err := report.Examples(r.Context(), s.db, queryHash, r.URL.Query().Get("collection"))
+	if err != nil {
+		logger.Error("failed to find examples of %s: %v", queryHash, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	examples := make([]Example, 0, len(records))
+	for _, record := range records {
+		example := Example{
+			QueryHash:   record.QueryHash,
+			ShapeHash:   record.ShapeHash,
+			Collection:  record.Collection,
+			PlanHash:    record.PlanHash,
+			PlanSummary: record.PlanSummary,
+		}
+
+		if record.Shape != nil {
+			if example.Shape, err = bson.MarshalExtJSON(record.Shape, false, false); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		if record.Document != nil {
+			if example.Document, err = bson.MarshalExtJSON(record.Document, false, false); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		examples = append(examples, example)
+	}
+
+	writeJSON(w, http.StatusOK, examples)
+}
+
+func (s *Server) timeseries(w http.ResponseWriter, r *http.Request, queryHash string) {
+	opts, err := options(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	points, err := report.Timeseries(r.Context(), s.db, queryHash, opts)
+	if err != nil {
+		logger.Error("failed to compute time series of %s: %v", queryHash, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, points)
+}
+
+func (s *Server) plans(w http.ResponseWriter, r *http.Request, queryHash string) {
+	opts, err := options(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	plans, err := report.Plans(r.Context(), s.db, queryHash, opts)
+	if err != nil {
+		logger.Error("failed to list plans of %s: %v", queryHash, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, plans)
+}
+
+// options reads the report options from the query string, defaulting to the first 20 rows of the last 24 hours.
+func options(query url.Values) (report.Options, error) {
+	opts := report.Options{
+		Collection: query.Get("collection"),
+		User:       query.Get("user"),
+		Sort:       query.Get("sort"),
+		Since:      time.Now().Add(-24 * time.Hour),
+		Limit:      20,
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if opts.Since, err = report.ParseTime(since); err != nil {
+			return opts, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if opts.Until, err = report.ParseTime(until); err != nil {
+			return opts, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit < 1 || opts.Limit > constant.SERVER_MAX_LIMIT {
+			return opts, fmt.Errorf("invalid limit %q, expected 1 to %v", limit, constant.SERVER_MAX_LIMIT)
+		}
+	}
+	if offset := query.Get("offset"); offset != "" {
+		if opts.Offset, err = strconv.Atoi(offset); err != nil || opts.Offset < 0 {
+			return opts, fmt.Errorf("invalid offset %q", offset)
+		}
+	}
+
+	return opts, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
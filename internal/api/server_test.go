@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer(nil) // Requests below are rejected before reaching the database
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/api/shapes", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/shapes?limit=0", http.StatusBadRequest},
+		{http.MethodGet, "/api/shapes?since=yesterday", http.StatusBadRequest},
+		{http.MethodGet, "/api/shapes/FFF0C0D3", http.StatusNotFound},
+		{http.MethodGet, "/api/shapes/FFF0C0D3/plans/extra", http.StatusNotFound},
+		{http.MethodGet, "/api/shapes/FFF0C0D3/timeseries?until=nope", http.StatusBadRequest},
+		{http.MethodGet, "/api/top/host", http.StatusNotFound},
+		{http.MethodGet, "/api/top/user?offset=-1", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected %v, got %v (%s)", test.method, test.path, test.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	opts, err := options(url.Values{"since": {"2022-06-01"}, "until": {"2022-06-02T00:00:00Z"}, "limit": {"50"}, "offset": {"100"}, "collection": {"app.users"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Since.Format("2006-01-02") != "2022-06-01" || opts.Until.Day() != 2 || opts.Limit != 50 || opts.Offset != 100 || opts.Collection != "app.users" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
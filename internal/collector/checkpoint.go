@@ -0,0 +1,114 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/utils/murmur3"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Checkpoint is the position of a tailer in system.profile, so that we can resume without losing or duplicating ops
+// after a reconnection or a restart.
+type Checkpoint struct {
+	ID        string    `bson:"_id"` // <host>/<database>
+	Timestamp time.Time `bson:"timestamp"`
+	// ts only has a millisecond precision, so we keep the hash of the entries already processed for the last
+	// timestamp to break ties
+	Seen      []int64   `bson:"seen"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+type CheckpointStore struct {
+	collection *mongo.Collection
+}
+
+func InitCheckpointCollection(ctx context.Context, db *mongo.Database) error {
+	if err := db.CreateCollection(ctx, constant.PROFILER_CHECKPOINT_COLLECTION); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewCheckpointStore(db *mongo.Database) *CheckpointStore {
+	return &CheckpointStore{collection: db.Collection(constant.PROFILER_CHECKPOINT_COLLECTION)}
+}
+
+// Load returns the stored checkpoint or an empty one if we never saw this source.
+func (s *CheckpointStore) Load(ctx context.Context, id string) (*Checkpoint, error) {
+	cp := &Checkpoint{}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(cp); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return &Checkpoint{ID: id}, nil
+		}
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func (s *CheckpointStore) Save(ctx context.Context, cp *Checkpoint) error {
+	cp.UpdatedAt = time.Now()
+
+	opts := options.Replace()
+	opts.SetUpsert(true)
+
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": cp.ID}, cp, opts)
+	return err
+}
+
+// Processed tells whether the entry was already handled before the checkpoint was taken.
+func (cp *Checkpoint) Processed(ts time.Time, hash int64) bool {
+	if ts.Before(cp.Timestamp) {
+		return true
+	}
+
+	if ts.Equal(cp.Timestamp) {
+		for _, seen := range cp.Seen {
+			if seen == hash {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Advance moves the checkpoint after the given entry.
+func (cp *Checkpoint) Advance(ts time.Time, hash int64) {
+	if ts.After(cp.Timestamp) {
+		cp.Timestamp = ts
+		cp.Seen = []int64{hash}
+	} else if ts.Equal(cp.Timestamp) {
+		cp.Seen = append(cp.Seen, hash)
+	}
+}
+
+// entryPosition extracts the timestamp and a hash of the profile entry without decoding the whole document.
+func entryPosition(data bson.Raw) (time.Time, int64, error) {
+	val, err := data.LookupErr("ts")
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	ts, ok := val.TimeOK()
+	if !ok {
+		return time.Time{}, 0, errors.New("ts is not a date")
+	}
+
+	hash, _ := murmur3.Hash(data, 0)
+
+	return ts, hash, nil
+}
@@ -0,0 +1,36 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	cp := &Checkpoint{}
+
+	if cp.Processed(ts, 1) {
+		t.Fatal("empty checkpoint should not have processed anything")
+	}
+
+	cp.Advance(ts, 1)
+	cp.Advance(ts, 2)
+
+	if !cp.Processed(ts, 1) || !cp.Processed(ts, 2) {
+		t.Error("entries with the checkpoint timestamp should be processed")
+	}
+	if cp.Processed(ts, 3) {
+		t.Error("unknown entry sharing the checkpoint timestamp should not be processed")
+	}
+	if !cp.Processed(ts.Add(-time.Millisecond), 3) {
+		t.Error("entry older than the checkpoint should be processed")
+	}
+
+	cp.Advance(ts.Add(time.Millisecond), 3)
+
+	if len(cp.Seen) != 1 || cp.Seen[0] != 3 {
+		t.Errorf("seen hashes should be reset when the timestamp moves, got %v", cp.Seen)
+	}
+}
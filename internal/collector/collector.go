@@ -3,7 +3,7 @@ package collector
 import (
 	"context"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	"github.com/guillotjulien/mongo-profiler/internal/constant"
@@ -11,188 +11,359 @@ import (
 	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type Collector struct {
-	client          *mgo.Client
-	slowThresholdMS uint64
-	profilerLevel   uint
+// ALL_DATABASES can be used as the only database to profile every non-system database, including the ones created
+// after the collector started.
+const ALL_DATABASES = "*"
+
+// Source identifies where a profile entry was read from.
+type Source struct {
+	Host  string // Node that served the operation
+	Shard string // Shard the node belongs to (sharded clusters only)
+}
+
+// Handler receives every profile entry read from system.profile along with the node that served the operation.
+type Handler func(ctx context.Context, source Source, data bson.Raw) error
+
+type CollectorOptions struct {
+	SlowThresholdMS uint64
+	ProfilerLevel   uint
+	AllMembers      bool             // Profile every member of the replica set instead of following the primary only
+	Databases       []string         // Databases to profile, default database of the connection string when empty
+	Checkpoints     *CheckpointStore // Where to persist the position of each tailer (kept in memory only when nil)
+	// Where to persist the profiler settings found on each node, so that they can be restored after a crash
+	ProfilerSettings *ProfilerSettingsStore
+	Workers          int // Number of goroutines running the handler
+	QueueSize        int // Number of profile entries waiting for a worker before QueuePolicy applies
+	QueuePolicy      QueuePolicy
+}
+
+// node is a server (or the primary of a replica set) whose system.profile collections we tail.
+type node struct {
+	client        *mgo.Client
+	source        Source
+	followPrimary bool
+}
 
-	lastTimestamp            time.Time
-	stopChangeStream         bool
-	currentSystemProfileSize int64
+type Collector struct {
+	client *mgo.Client
+	opts   CollectorOptions
+	shard  string // Set when the collector profiles one shard of a sharded cluster
+
+	pool     *pool         // Shared by the collectors of every shard
+	stopping chan struct{} // Closed when Stop is called
+	drained  chan struct{} // Closed once every queued entry was handled after stopping
+
+	lock    sync.Mutex
+	nodes   []*node
+	tailers []*tailer
+	tailed  map[string]bool // <host>/<database> already being tailed
+	shards  []*Collector
+	wg      sync.WaitGroup
 }
 
-func NewCollector(client *mgo.Client, slowThresholdMS uint64, profilerLevel uint) *Collector {
+func NewCollector(client *mgo.Client, opts CollectorOptions) *Collector {
 	c := &Collector{}
 	c.client = client
-	c.slowThresholdMS = slowThresholdMS
-	c.profilerLevel = profilerLevel
+	c.opts = opts
+	c.stopping = make(chan struct{})
+	c.drained = make(chan struct{})
+	c.tailed = map[string]bool{}
 
 	return c
 }
 
-func (c *Collector) Start(ctx context.Context, handler func(ctx context.Context, data bson.Raw) error) error {
+func (c *Collector) Start(ctx context.Context, handler Handler) error {
+	defer close(c.drained)
+
+	if c.pool == nil {
+		c.pool = newPool(handler, c.opts.Workers, c.opts.QueueSize, c.opts.QueuePolicy)
+		c.pool.start(ctx)
+
+		defer c.pool.close()
+	}
+
 	if err := c.client.Connect(ctx); err != nil {
 		return fmt.Errorf("failed to connect to Mongo host %s (database: %s): %w", c.client.Connstr.Hosts, c.client.Connstr.Database, err)
 	}
 
-	if err := c.increaseSystemProfileSize(ctx); err != nil {
-		return fmt.Errorf("failed to initialize collector: %w", err)
+	hello, err := c.client.Hello(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to identify Mongo host %s: %w", c.client.Connstr.Hosts, err)
 	}
 
-	db := c.client.GetDefaultDatabase()
+	if hello.IsMongos() { // system.profile doesn't exist on mongos, profile the shards instead
+		return c.startShards(ctx, handler)
+	}
 
-	// start change stream
-	collection := db.Collection(constant.PROFILER_SYSTEM_PROFILE)
+	if err := c.discoverNodes(ctx); err != nil {
+		return err
+	}
 
-	// No way to open a change stream against a system collection so use a tailable cursor instead (https://www.mongodb.com/community/forums/t/why-change-streams-cannot-be-used-with-local-database/3063)
-	var cursor *mongo.Cursor
-	cursorOptions := options.FindOptions{}
-	cursorOptions.SetCursorType(options.Tailable)
-	cursorOptions.SetSort(bson.M{"$natural": 1})
+	databases, err := c.databases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list databases of Mongo host %s: %w", c.client.Connstr.Hosts, err)
+	}
 
-	logger.Info("starting change stream against %s", constant.PROFILER_SYSTEM_PROFILE)
+	c.startTailers(ctx, databases)
 
-	for !c.stopChangeStream {
-		if ctx.Err() != nil {
-			logger.Warn("change stream cursor error %w", ctx.Err())
-		}
+	if c.allDatabases() { // Pick up databases created after we started
+		ticker := time.NewTicker(constant.PROFILER_DATABASE_DISCOVERY_INTERVAL)
+		defer ticker.Stop()
 
-		if cursor != nil && cursor.Err() != nil {
-			logger.Warn("change stream cursor error %w", cursor.Err())
+	discovery:
+		for {
+			select {
+			case <-ctx.Done():
+				break discovery
+			case <-c.stopping:
+				break discovery
+			case <-ticker.C:
+			}
 
-			if e, ok := cursor.Err().(mongo.ServerError); ok {
-				if e.HasErrorCode(constant.MONGO_CAPPED_POSITION_LOST_ERROR) {
-					logger.Info("attempting to resize %s", constant.PROFILER_SYSTEM_PROFILE)
-					if err := c.increaseSystemProfileSize(ctx); err != nil {
-						logger.Fatal("failed to resize %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
-					}
-					logger.Info("resized %s to %v bytes", constant.PROFILER_SYSTEM_PROFILE, c.currentSystemProfileSize)
-				}
-			} else if e, ok := cursor.Err().(mongo.CommandError); ok {
-				log.Fatal(e.Code) // FIXME: (mongo.CommandError)
-			} else {
-				log.Fatal(cursor.Err())
-				// TODO: Crash for now
+			databases, err := c.databases(ctx)
+			if err != nil {
+				logger.Warn("failed to list databases of Mongo host %s: %v", c.client.Connstr.Hosts, err)
+				continue
 			}
+
+			c.startTailers(ctx, databases)
 		}
+	}
 
-		if cursor == nil || cursor.ID() == 0 || ctx.Err() != nil || cursor.Err() != nil { // Cursor was closed - create a new cursor (actually fine since this is a very small capped collection)
-			logger.Info("change stream cursor closed for %s. Will retry after %s", constant.PROFILER_SYSTEM_PROFILE, constant.RETRY_AFTER.String())
-			select { // make sure we can cancel the wait and close fast
-			case <-ctx.Done():
-			case <-time.After(constant.RETRY_AFTER):
-			}
+	c.wg.Wait()
 
-			if c.stopChangeStream { // Make sure we quit when we were sleeping and we suddenly stop the change stream
-				break
-			}
+	return nil
+}
 
-			cursorQuery := bson.M{
-				"ns": bson.M{
-					"$regex": fmt.Sprintf("^%s\\.", c.client.Connstr.Database),                                  // only the database in our conf
-					"$ne":    fmt.Sprintf("%s.%s", c.client.Connstr.Database, constant.PROFILER_SYSTEM_PROFILE), // all collections except system.profile
-				},
-				"ts": bson.M{
-					"$gt": c.lastTimestamp,
-				},
-			}
+// discoverNodes lists the servers to profile: the primary (followed across elections) or every member of the
+// replica set.
+func (c *Collector) discoverNodes(ctx context.Context) error {
+	if !c.opts.AllMembers {
+		c.lock.Lock()
+		c.nodes = []*node{{client: c.client, source: Source{Host: c.client.Primary(), Shard: c.shard}, followPrimary: true}}
+		c.lock.Unlock()
+		return nil
+	}
 
-			var err error
-			cursor, err = collection.Find(ctx, cursorQuery, &cursorOptions)
-			if err != nil {
-				logger.Error("failed to obtain cursor for %s: %v", constant.PROFILER_SYSTEM_PROFILE, err)
-			}
-		}
+	members, err := c.client.Members(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to discover members of Mongo host %s: %w", c.client.Connstr.Hosts, err)
+	}
 
-		if cursor == nil {
-			continue
-		}
+	logger.Info("profiling %v members: %v", len(members), members)
 
-		if hasNext := cursor.TryNext(ctx); !hasNext {
-			continue
+	for _, member := range members {
+		memberClient, err := c.client.NewMemberClient(member)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate client for member %s: %w", member, err)
 		}
 
-		// TODO: decode and store last timestamp. PB: Overhead of decoding: Java does that in the thread pool, but is that safe (e.g. race condition)??
-		// Worse case we just have a few duplicates so not the end of the world.
-		// Or unique constraint on lsid.id? -> Doesn't work, not all ops have this...
+		if err := memberClient.Connect(ctx); err != nil {
+			// Member might be down for maintenance, we'll keep trying to set it up from its tailers
+			logger.Error("failed to connect to member %s: %v", member, err)
+		}
 
-		go handler(ctx, cursor.Current) // The result isn't important. We can miss a few without any issue
+		c.lock.Lock()
+		c.nodes = append(c.nodes, &node{client: memberClient, source: Source{Host: member, Shard: c.shard}})
+		c.lock.Unlock()
 	}
+
 	return nil
 }
 
-func (c *Collector) Stop(ctx context.Context) error {
-	// 1. stop change stream
-	c.stopChangeStream = true
+func (c *Collector) allDatabases() bool {
+	return len(c.opts.Databases) == 1 && c.opts.Databases[0] == ALL_DATABASES
+}
 
-	logger.Info("attempting to stop collector for mongo host %v (database: %s)", c.client.Connstr.Hosts, c.client.Connstr.Database)
+func (c *Collector) databases(ctx context.Context) ([]string, error) {
+	return listDatabases(ctx, c.client, c.opts.Databases)
+}
 
-	// 2. stop profiler
-	res := c.client.GetDefaultDatabase().RunCommand(ctx, bson.M{
-		"profile": 0,
-	})
+// listDatabases resolves the databases option: the database of the connection string when empty, every non-system
+// database for ALL_DATABASES.
+func listDatabases(ctx context.Context, client *mgo.Client, databases []string) ([]string, error) {
+	if len(databases) == 0 {
+		return []string{client.Connstr.Database}, nil
+	}
 
-	if res.Err() != nil {
-		return fmt.Errorf("failed to stop profiler for Mongo host %v (database: %s): %w", c.client.Connstr.Hosts, c.client.Connstr.Database, res.Err())
+	if len(databases) != 1 || databases[0] != ALL_DATABASES {
+		return databases, nil
 	}
 
-	logger.Info("successfully stopped collector for mongo host %v (database: %s)", c.client.Connstr.Hosts, c.client.Connstr.Database)
+	names, err := client.C.ListDatabaseNames(ctx, bson.M{}, options.ListDatabases().SetNameOnly(true))
+	if err != nil {
+		return nil, err
+	}
 
-	// 3. close connection with source store
-	if err := c.client.Disconnect(ctx); err != nil {
-		return fmt.Errorf("failed to close connection with Mongo host %v (database: %s): %w", c.client.Connstr.Hosts, c.client.Connstr.Database, err)
+	databases = []string{}
+	for _, name := range names {
+		if name == "admin" || name == "local" || name == "config" {
+			continue
+		}
+		databases = append(databases, name)
 	}
 
-	return nil
+	return databases, nil
 }
 
-func (c *Collector) increaseSystemProfileSize(ctx context.Context) error {
-	db := c.client.GetDefaultDatabase()
+// startTailers starts tailing the databases that aren't tailed yet on every node.
+func (c *Collector) startTailers(ctx context.Context, databases []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	// Stop profiler - no problem if it fails
-	db.RunCommand(ctx, bson.M{
-		"profile": 0,
-	})
+	select {
+	case <-c.stopping:
+		return
+	default:
+	}
+
+	for _, n := range c.nodes {
+		for _, database := range databases {
+			key := fmt.Sprintf("%s/%s", n.source.Host, database)
+			if c.tailed[key] {
+				continue
+			}
+			c.tailed[key] = true
+
+			logger.Info("profiling database %s on %s", database, n.source.Host)
+
+			t := newTailer(n.client, n.source, database, n.followPrimary, c.opts)
+			c.tailers = append(c.tailers, t)
+
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+
+				if err := t.run(ctx, c.pool); err != nil {
+					logger.Error("collector for database %s on %s stopped: %v", t.database, t.source.Host, err)
+				}
+			}()
+		}
+	}
+}
 
-	// Clean current profiling collection to make sure it is capped
-	err := db.Collection(constant.PROFILER_SYSTEM_PROFILE).Drop(ctx)
+func (c *Collector) startShards(ctx context.Context, handler Handler) error {
+	shards, err := c.client.Shards(ctx)
 	if err != nil {
-		// TODO: Depends on the error. If the collection is already here, we don't care
-		return fmt.Errorf("failed to drop collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+		return fmt.Errorf("failed to discover shards of Mongo host %s: %w", c.client.Connstr.Hosts, err)
 	}
 
-	c.currentSystemProfileSize += constant.PROFILER_SYSTEM_PROFILE_CAPPED_INCREMENT
+	logger.Info("connected to a mongos, profiling %v shards", len(shards))
 
-	createCollectionOptions := options.CreateCollectionOptions{}
-	createCollectionOptions.SetCapped(true)
-	createCollectionOptions.SetSizeInBytes(c.currentSystemProfileSize)
+	for _, shard := range shards {
+		shardClient, err := c.client.NewShardClient(shard)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate client for shard %s: %w", shard.ID, err)
+		}
+
+		sc := NewCollector(shardClient, c.opts)
+		sc.shard = shard.ID
+		sc.pool = c.pool // Entries of every shard go through the same workers
+		if !c.addShard(sc) {
+			return nil // Stopping, Stop wouldn't see this shard
+		}
 
-	if err := db.CreateCollection(ctx, constant.PROFILER_SYSTEM_PROFILE, &createCollectionOptions); err != nil {
-		if e, ok := err.(mongo.ServerError); ok {
-			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
-				return fmt.Errorf("failed to create collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+		logger.Info("starting collector for shard %s (%s)", shard.ID, shard.Host)
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+
+			if err := sc.Start(ctx, handler); err != nil {
+				logger.Error("collector for shard %s stopped: %v", sc.shard, err)
 			}
-		} else {
-			return fmt.Errorf("failed to create collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+		}()
+	}
+
+	c.wg.Wait()
+
+	return nil
+}
+
+func (c *Collector) Stop(ctx context.Context) error {
+	logger.Info("attempting to stop collector for mongo host %v (database: %s)", c.client.Connstr.Hosts, c.client.Connstr.Database)
+
+	var stopErr error
+
+	c.lock.Lock()
+	select {
+	case <-c.stopping: // No tailer or shard can be added past this point
+	default:
+		close(c.stopping)
+	}
+	shards, tailers, nodes := c.shards, c.tailers, c.nodes
+	c.lock.Unlock()
+
+	for _, sc := range shards {
+		if err := sc.Stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
+		}
+	}
+
+	for _, t := range tailers {
+		if err := t.stop(ctx); err != nil && stopErr == nil {
+			stopErr = err
 		}
 	}
 
-	// turn on profiler
-	logger.Info("Setting profiler to level %v", c.profilerLevel)
-	logger.Info("Slow query threshold %vms", c.slowThresholdMS)
+	// Wait for the tailers to exit and the workers to handle what's left in the queue
+	select {
+	case <-c.drained:
+	case <-ctx.Done():
+	}
+
+	for _, n := range nodes {
+		if n.client == c.client {
+			continue
+		}
 
-	res := db.RunCommand(ctx, bson.D{
-		{Key: "profile", Value: c.profilerLevel},
-		{Key: "slowms", Value: c.slowThresholdMS},
-	})
+		if err := n.client.Disconnect(ctx); err != nil {
+			logger.Warn("failed to close connection with member %s: %v", n.source.Host, err)
+		}
+	}
 
-	if res.Err() != nil {
-		return fmt.Errorf("failed to start collector: %w", res.Err())
+	if stopErr != nil {
+		return stopErr
+	}
+
+	logger.Info("successfully stopped collector for mongo host %v (database: %s)", c.client.Connstr.Hosts, c.client.Connstr.Database)
+
+	// close connection with source store
+	if err := c.client.Disconnect(ctx); err != nil {
+		return fmt.Errorf("failed to close connection with Mongo host %v (database: %s): %w", c.client.Connstr.Hosts, c.client.Connstr.Database, err)
 	}
 
 	return nil
 }
+
+// addShard returns false when the collector is stopping, in which case the shard must not be started.
+func (c *Collector) addShard(sc *Collector) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.stopping:
+		return false
+	default:
+	}
+
+	c.shards = append(c.shards, sc)
+
+	return true
+}
+
+// retryAfter is the time to wait after the given number of consecutive failures.
+func retryAfter(failures int) time.Duration {
+	wait := constant.RETRY_AFTER
+	for i := 1; i < failures && wait < constant.MAX_RETRY_AFTER; i++ {
+		wait *= 2
+	}
+	if wait > constant.MAX_RETRY_AFTER {
+		wait = constant.MAX_RETRY_AFTER
+	}
+
+	return wait
+}
@@ -0,0 +1,27 @@
+package collector
+
+import (
+	"context"
+	"testing"
+
+	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
+)
+
+func TestAddShardWhileStopping(t *testing.T) {
+	t.Parallel()
+
+	client, err := mgo.NewClient(context.Background(), "mongodb://mongos:27017/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCollector(client, CollectorOptions{})
+	if !c.addShard(NewCollector(client, CollectorOptions{})) {
+		t.Error("expected the shard to be added")
+	}
+
+	close(c.stopping) // As done by Stop
+	if c.addShard(NewCollector(client, CollectorOptions{})) || len(c.shards) != 1 {
+		t.Errorf("expected no shard to be added once stopping, got %v shards", len(c.shards))
+	}
+}
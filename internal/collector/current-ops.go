@@ -0,0 +1,481 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
+	"github.com/guillotjulien/mongo-profiler/internal/redact"
+	"github.com/guillotjulien/mongo-profiler/internal/shape"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CurrentOpStatus string
+
+const (
+	CurrentOpRunning  CurrentOpStatus = "running"
+	CurrentOpFinished CurrentOpStatus = "finished" // Gone from $currentOp, it completed, failed or was killed by someone else
+	CurrentOpKilled   CurrentOpStatus = "killed"   // Gone from $currentOp after we killed it
+	CurrentOpUnknown  CurrentOpStatus = "unknown"  // The poller stopped while the operation was still running
+)
+
+// CurrentOpRecord follows an operation seen running for longer than the threshold by $currentOp, from the first poll
+// it shows up in to the first poll it's gone from. Unlike slow ops, it's stored while the operation is still running.
+type CurrentOpRecord struct {
+	ID             string          `bson:"_id"`  // <host>/<opid>/<startedAt>
+	OpID           interface{}     `bson:"opid"` // As expected by killOp: a number, or "<shard>:<number>" through a mongos
+	Host           string          `bson:"host"`
+	Shard          string          `bson:"shard,omitempty"`
+	Database       string          `bson:"database,omitempty"`
+	Collection     string          `bson:"collection,omitempty"`
+	OP             string          `bson:"op,omitempty"`
+	User           string          `bson:"user,omitempty"`
+	AppName        string          `bson:"appName,omitempty"`
+	Client         string          `bson:"client,omitempty"`
+	QueryHash      string          `bson:"queryHash,omitempty"` // Same as the one of the slowops record the operation will produce
+	ShapeHash      string          `bson:"shapeHash,omitempty"`
+	PlanSummary    string          `bson:"planSummary,omitempty"`
+	Shape          bson.D          `bson:"shape,omitempty"`
+	Command        bson.Raw        `bson:"command,omitempty"` // Redacted like examples
+	StartedAt      time.Time       `bson:"startedAt"`
+	FirstSeen      time.Time       `bson:"firstSeen"`
+	LastSeen       time.Time       `bson:"lastSeen"`
+	EndedAt        time.Time       `bson:"endedAt,omitempty"` // Somewhere between lastSeen and endedAt
+	DurationMS     int64           `bson:"durationMS"`        // Running time at the last poll
+	NumYields      int             `bson:"numYields,omitempty"`
+	WaitingForLock bool            `bson:"waitingForLock"`
+	Status         CurrentOpStatus `bson:"status"`
+	KillRule       string          `bson:"killRule,omitempty"` // Rule of the kill policy we killed it for
+
+	killPending bool // Set by the server once killOp reached the operation
+	kill        killState
+}
+
+// currentOp is the part of a $currentOp document we read.
+type currentOp struct {
+	Host             string      `bson:"host"`
+	Shard            string      `bson:"shard"`
+	OpID             interface{} `bson:"opid"`
+	Active           bool        `bson:"active"`
+	MicrosecsRunning int64       `bson:"microsecs_running"`
+	OP               string      `bson:"op"`
+	NS               string      `bson:"ns"`
+	Command          bson.Raw    `bson:"command"`
+	QueryHash        string      `bson:"queryHash"`
+	PlanSummary      string      `bson:"planSummary"`
+	Client           string      `bson:"client"`
+	ClientS          string      `bson:"client_s"` // Through a mongos
+	AppName          string      `bson:"appName"`
+	EffectiveUsers   []struct {
+		User string `bson:"user"`
+		DB   string `bson:"db"`
+	} `bson:"effectiveUsers"`
+	NumYields      int  `bson:"numYields"`
+	WaitingForLock bool `bson:"waitingForLock"`
+	KillPending    bool `bson:"killPending"`
+
+	Document bson.Raw `bson:"-"`
+}
+
+type CurrentOpOptions struct {
+	Interval  time.Duration // Time between two polls
+	Threshold time.Duration // Operations running for less time are ignored
+	Databases []string      // Same as CollectorOptions.Databases
+	Redactor  *redact.Redactor
+	Killer    *Killer // Kills the operations matching its policy, nothing is killed when nil
+}
+
+// CurrentOpPoller runs $currentOp on the listened installation at every interval and records the lifecycle of the
+// long-running operations. Through a mongos, $currentOp reports the operations of every shard.
+type CurrentOpPoller struct {
+	client     *mgo.Client
+	collection *mongo.Collection
+	opts       CurrentOpOptions
+	ctx        context.Context
+
+	lock    sync.Mutex
+	running map[string]*CurrentOpRecord // <host>/<opid>
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	failed *metrics.Counter
+}
+
+func InitCurrentOpCollection(ctx context.Context, db *mongo.Database) error {
+	if err := db.CreateCollection(ctx, constant.PROFILER_CURRENTOPS_COLLECTION); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	collection := db.Collection(constant.PROFILER_CURRENTOPS_COLLECTION)
+
+	options := options.Index()
+	options.SetExpireAfterSeconds(constant.PROFILER_SLOWOPS_EXPIRE_SECONDS)
+
+	_, err := collection.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.M{"lastSeen": 1},
+				Options: options,
+			},
+			{
+				Keys: bson.M{"status": 1},
+			},
+			{
+				Keys: bson.M{"queryHash": 1},
+			},
+		},
+	)
+	if err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_INDEX_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewCurrentOpPoller(ctx context.Context, client *mgo.Client, db *mongo.Database, opts CurrentOpOptions) *CurrentOpPoller {
+	if len(opts.Databases) == 0 {
+		opts.Databases = []string{client.Connstr.Database}
+	}
+
+	p := &CurrentOpPoller{}
+	p.client = client
+	p.collection = db.Collection(constant.PROFILER_CURRENTOPS_COLLECTION)
+	p.opts = opts
+	p.ctx = ctx
+	p.running = map[string]*CurrentOpRecord{}
+	p.done = make(chan struct{})
+	p.failed = metrics.NewCounter("currentops.failed")
+
+	p.wg.Add(1)
+	go p.pollPeriodically()
+
+	return p
+}
+
+// Poll runs $currentOp once and stores the operations that started, are still running or ended since the last poll.
+func (p *CurrentOpPoller) Poll(ctx context.Context) error {
+	ops, err := p.currentOps(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	p.lock.Lock()
+	seen := map[string]bool{}
+	checked := map[string]*CurrentOpRecord{} // Copies, the kill policy is applied without holding the lock
+	for _, op := range ops {
+		if !p.watched(op) {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%v", op.Host, op.OpID)
+		seen[key] = true
+
+		record, ok := p.running[key]
+		if !ok {
+			record = op.toRecord(now, p.opts.Redactor)
+			p.running[key] = record
+		}
+		record.update(op, now)
+
+		if p.opts.Killer != nil {
+			snapshot := *record
+			checked[key] = &snapshot
+		}
+	}
+	p.lock.Unlock()
+
+	for _, record := range checked {
+		p.opts.Killer.Check(ctx, record)
+	}
+
+	p.lock.Lock()
+	for key, checked := range checked {
+		if record, ok := p.running[key]; ok {
+			record.KillRule = checked.KillRule
+			record.kill = checked.kill
+		}
+	}
+
+	changed := make([]*CurrentOpRecord, 0, len(p.running))
+	finished := map[string]string{} // <host>/<opid> -> _id, forgotten once stored
+	killed := []CurrentOpRecord{}   // Gone since we requested the kill
+	for key, record := range p.running {
+		if !seen[key] {
+			if record.Status == CurrentOpRunning { // Otherwise it ended before a failed store
+				record.Status = CurrentOpFinished
+				record.EndedAt = now
+				if record.KillRule != "" {
+					record.Status = CurrentOpKilled
+					killed = append(killed, *record)
+				}
+			}
+			finished[key] = record.ID
+		}
+
+		snapshot := *record
+		changed = append(changed, &snapshot)
+	}
+	p.lock.Unlock()
+
+	for i := range killed {
+		p.opts.Killer.Confirm(ctx, &killed[i])
+	}
+
+	if err := p.store(ctx, changed); err != nil {
+		return err // Ended operations are stored again at the next poll
+	}
+
+	p.lock.Lock()
+	for key, id := range finished {
+		if record, ok := p.running[key]; ok && record.ID == id {
+			delete(p.running, key)
+		}
+	}
+	p.lock.Unlock()
+
+	return nil
+}
+
+// Running returns a copy of the operations currently running for longer than the threshold.
+func (p *CurrentOpPoller) Running() []CurrentOpRecord {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	records := make([]CurrentOpRecord, 0, len(p.running))
+	for _, record := range p.running {
+		if record.Status == CurrentOpRunning {
+			records = append(records, *record)
+		}
+	}
+
+	return records
+}
+
+// Close stops polling. Operations still running are stored with an unknown status, since we won't see them end.
+func (p *CurrentOpPoller) Close(ctx context.Context) {
+	close(p.done)
+	p.wg.Wait()
+
+	p.lock.Lock()
+	records := make([]*CurrentOpRecord, 0, len(p.running))
+	for key, record := range p.running {
+		if record.Status == CurrentOpRunning {
+			record.Status = CurrentOpUnknown
+		}
+		records = append(records, record)
+		delete(p.running, key)
+	}
+	p.lock.Unlock()
+
+	if err := p.store(ctx, records); err != nil {
+		logger.Warn("%v", err)
+	}
+}
+
+func (p *CurrentOpPoller) pollPeriodically() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			if err := p.Poll(p.ctx); err != nil {
+				logger.Warn("%v", err)
+			}
+		}
+	}
+}
+
+func (p *CurrentOpPoller) currentOps(ctx context.Context) ([]*currentOp, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$currentOp", Value: bson.D{{Key: "allUsers", Value: true}, {Key: "idleConnections", Value: false}}}},
+		{{Key: "$match", Value: bson.D{
+			{Key: "active", Value: true},
+			{Key: "microsecs_running", Value: bson.D{{Key: "$gte", Value: p.opts.Threshold.Microseconds()}}},
+		}}},
+	}
+
+	cursor, err := p.client.C.Database("admin").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run $currentOp on Mongo host %s: %w", p.client.Connstr.Hosts, err)
+	}
+	defer cursor.Close(ctx)
+
+	ops := []*currentOp{}
+	for cursor.Next(ctx) {
+		op := &currentOp{}
+		if err := cursor.Decode(op); err != nil {
+			return nil, fmt.Errorf("failed to decode $currentOp document: %w", err)
+		}
+		op.Document = append(bson.Raw(nil), cursor.Current...)
+
+		ops = append(ops, op)
+	}
+
+	return ops, cursor.Err()
+}
+
+// watched tells whether the operation runs against one of the databases we monitor. Internal operations (replication,
+// TTL monitor, tailing system.profile...) are skipped.
+func (p *CurrentOpPoller) watched(op *currentOp) bool {
+	if op.OP == "none" || op.NS == "" || strings.HasSuffix(op.NS, "."+constant.PROFILER_SYSTEM_PROFILE) {
+		return false
+	}
+
+	database, _, _ := strings.Cut(op.NS, ".")
+	if database == "admin" || database == "local" || database == "config" {
+		return false
+	}
+
+	for _, name := range p.opts.Databases {
+		if name == ALL_DATABASES || name == database {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *CurrentOpPoller) store(ctx context.Context, records []*CurrentOpRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(records))
+	for _, record := range records {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": record.ID}).
+			SetReplacement(record).
+			SetUpsert(true))
+	}
+
+	opts := options.BulkWrite()
+	opts.SetOrdered(false)
+
+	if _, err := p.collection.BulkWrite(ctx, models, opts); err != nil {
+		p.failed.Add(int64(len(models)))
+		return fmt.Errorf("failed to store %v current ops: %w", len(models), err)
+	}
+
+	return nil
+}
+
+func (op *currentOp) toRecord(now time.Time, redactor *redact.Redactor) *CurrentOpRecord {
+	startedAt := now.Add(-time.Duration(op.MicrosecsRunning) * time.Microsecond).Truncate(time.Millisecond)
+
+	record := &CurrentOpRecord{
+		ID:          fmt.Sprintf("%s/%v/%d", op.Host, op.OpID, startedAt.UnixMilli()),
+		OpID:        op.OpID,
+		Host:        op.Host,
+		Shard:       op.Shard,
+		Collection:  op.NS,
+		OP:          op.OP,
+		AppName:     op.AppName,
+		Client:      clientHost(op.Client),
+		PlanSummary: op.PlanSummary,
+		StartedAt:   startedAt,
+		FirstSeen:   now,
+	}
+	record.Database, _, _ = strings.Cut(op.NS, ".")
+	if record.Client == "" {
+		record.Client = clientHost(op.ClientS)
+	}
+	if len(op.EffectiveUsers) > 0 { // Formatted like the user of profile entries
+		record.User = fmt.Sprintf("%s@%s", op.EffectiveUsers[0].User, op.EffectiveUsers[0].DB)
+	}
+
+	record.Shape = op.shape()
+	record.ShapeHash = shape.Hash(record.Shape)
+	record.QueryHash = op.QueryHash
+	if record.QueryHash == "" {
+		record.QueryHash = record.ShapeHash
+	}
+
+	command, err := op.redactedCommand(redactor)
+	if err != nil {
+		logger.Warn("%v", err) // Better no command than one leaking data
+	}
+	record.Command = command
+
+	return record
+}
+
+// redactedCommand redacts the command the same way as the examples of slow ops.
+func (op *currentOp) redactedCommand(redactor *redact.Redactor) (bson.Raw, error) {
+	if op.Command == nil {
+		return nil, nil
+	}
+
+	document, err := bson.Marshal(bson.D{{Key: "command", Value: op.Command}})
+	if err == nil {
+		document, err = redactor.Redact(op.NS, document)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact current op of %s: %w", op.NS, err)
+	}
+
+	command, _ := bson.Raw(document).Lookup("command").DocumentOK()
+
+	return command, nil
+}
+
+// update refreshes what changes while the operation runs.
+func (r *CurrentOpRecord) update(op *currentOp, now time.Time) {
+	r.LastSeen = now
+	r.DurationMS = op.MicrosecsRunning / 1000
+	r.NumYields = op.NumYields
+	r.WaitingForLock = op.WaitingForLock
+	r.killPending = op.KillPending
+	r.Status = CurrentOpRunning
+	if op.PlanSummary != "" {
+		r.PlanSummary = op.PlanSummary
+	}
+}
+
+// shape is computed like the one of profile entries, so that running operations share the shape of the slow ops they
+// will produce. A getMore has the shape of the command that opened the cursor.
+func (op *currentOp) shape() bson.D {
+	if op.OP == "getmore" {
+		originating, ok := op.Document.Lookup("cursor", "originatingCommand").DocumentOK()
+		if !ok { // Before MongoDB 4.2
+			originating, ok = op.Document.Lookup("originatingCommand").DocumentOK()
+		}
+		if ok {
+			return shape.Of(op.NS, originating)
+		}
+	}
+
+	if op.Command != nil {
+		return shape.Of(op.NS, op.Command)
+	}
+
+	return bson.D{{Key: "ns", Value: op.NS}, {Key: "op", Value: op.OP}}
+}
@@ -0,0 +1,102 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/redact"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCurrentOpRecord(t *testing.T) {
+	t.Parallel()
+
+	command := bson.D{
+		{Key: "find", Value: "users"},
+		{Key: "filter", Value: bson.D{{Key: "email", Value: "john@example.com"}}},
+		{Key: "$db", Value: "app"},
+	}
+
+	profiled, err := bson.Marshal(bson.D{
+		{Key: "op", Value: "query"},
+		{Key: "ns", Value: "app.users"},
+		{Key: "command", Value: command},
+		{Key: "millis", Value: int32(120)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := NewProfilerEntry(Source{Host: "node1:27017"}, profiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, err := bson.Marshal(bson.D{
+		{Key: "host", Value: "node1:27017"},
+		{Key: "opid", Value: int32(4242)},
+		{Key: "active", Value: true},
+		{Key: "microsecs_running", Value: int64(12500000)},
+		{Key: "op", Value: "query"},
+		{Key: "ns", Value: "app.users"},
+		{Key: "command", Value: command},
+		{Key: "planSummary", Value: "COLLSCAN"},
+		{Key: "client", Value: "10.0.0.12:51234"},
+		{Key: "appName", Value: "billing"},
+		{Key: "effectiveUsers", Value: bson.A{bson.D{{Key: "user", Value: "app"}, {Key: "db", Value: "admin"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := &currentOp{}
+	if err := bson.Unmarshal(running, op); err != nil {
+		t.Fatal(err)
+	}
+	op.Document = running
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	record := op.toRecord(now, &redact.Redactor{Default: redact.ModePlaceholder})
+	record.update(op, now)
+
+	if record.ShapeHash != entry.ShapeHash || record.QueryHash != entry.ToSlowOpsRecord().QueryHash {
+		t.Errorf("expected the shape of the profile entry %v, got %v", entry.ShapeHash, record.ShapeHash)
+	}
+	if !record.StartedAt.Equal(now.Add(-12500 * time.Millisecond)) {
+		t.Errorf("unexpected start %v", record.StartedAt)
+	}
+	if record.ID != "node1:27017/4242/1654084787500" {
+		t.Errorf("unexpected id %v", record.ID)
+	}
+	if record.User != "app@admin" || record.Client != "10.0.0.12" || record.Database != "app" {
+		t.Errorf("unexpected identity %+v", record)
+	}
+	if record.DurationMS != 12500 || record.Status != CurrentOpRunning {
+		t.Errorf("unexpected progress %+v", record)
+	}
+	if email := record.Command.Lookup("filter", "email").StringValue(); email != "?string" {
+		t.Errorf("expected the email to be redacted, got %v", email)
+	}
+}
+
+func TestCurrentOpWatched(t *testing.T) {
+	t.Parallel()
+
+	p := &CurrentOpPoller{opts: CurrentOpOptions{Databases: []string{"app"}}}
+
+	for _, tc := range []struct {
+		op      currentOp
+		watched bool
+	}{
+		{currentOp{OP: "query", NS: "app.users"}, true},
+		{currentOp{OP: "query", NS: "other.users"}, false},
+		{currentOp{OP: "getmore", NS: "app.system.profile"}, false},
+		{currentOp{OP: "getmore", NS: "local.oplog.rs"}, false},
+		{currentOp{OP: "none", NS: ""}, false},
+	} {
+		if watched := p.watched(&tc.op); watched != tc.watched {
+			t.Errorf("%v %v: expected watched to be %v", tc.op.OP, tc.op.NS, tc.watched)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CursorSummaryRecord sums up every batch read from a cursor: the find/aggregate that opened it and its getMores.
+type CursorSummaryRecord struct {
+	ID           string    `bson:"_id"` // <host>/<cursorID>
+	Host         string    `bson:"host"`
+	Shard        string    `bson:"shard,omitempty"`
+	Database     string    `bson:"database,omitempty"`
+	Collection   string    `bson:"collection"`
+	CursorID     int64     `bson:"cursorID"`
+	QueryHash    string    `bson:"queryHash,omitempty"` // Of the originating command
+	ShapeHash    string    `bson:"shapeHash,omitempty"`
+	PlanSummary  string    `bson:"planSummary,omitempty"`
+	FirstSeen    time.Time `bson:"firstSeen"`
+	LastSeen     time.Time `bson:"lastSeen"`
+	Batches      int       `bson:"batches"` // Profiled ops only, fast batches aren't in system.profile at level 1
+	DurationMS   int       `bson:"durationMS"`
+	NReturned    int       `bson:"nreturned"`
+	DocExamined  int       `bson:"docsExamined"`
+	KeysExamined int       `bson:"keysExamined"`
+	Exhausted    bool      `bson:"exhausted"`
+}
+
+// cursorOrigin is what a getMore inherits from the op that opened its cursor.
+type cursorOrigin struct {
+	queryHash   string
+	shapeHash   string
+	planHash    string
+	planSummary string
+	seenAt      time.Time
+}
+
+// CursorTracker links getMores to the op that opened their cursor and maintains the cursor summaries. Summaries are
+// accumulated in memory and upserted every flush interval.
+type CursorTracker struct {
+	collection    *mongo.Collection
+	flushInterval time.Duration
+	ctx           context.Context
+
+	lock    sync.Mutex
+	origins map[string]*cursorOrigin
+	pending map[string]*CursorSummaryRecord // Deltas since the last flush
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	failed *metrics.Counter
+}
+
+func InitCursorSummaryCollection(ctx context.Context, db *mongo.Database) error {
+	if err := db.CreateCollection(ctx, constant.PROFILER_CURSORS_COLLECTION); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	collection := db.Collection(constant.PROFILER_CURSORS_COLLECTION)
+
+	options := options.Index()
+	options.SetExpireAfterSeconds(constant.PROFILER_SLOWOPS_EXPIRE_SECONDS)
+
+	_, err := collection.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.M{"lastSeen": 1},
+				Options: options,
+			},
+			{
+				Keys: bson.M{"queryHash": 1},
+			},
+		},
+	)
+	if err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_INDEX_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewCursorTracker(ctx context.Context, db *mongo.Database, flushInterval time.Duration) *CursorTracker {
+	t := &CursorTracker{}
+	t.collection = db.Collection(constant.PROFILER_CURSORS_COLLECTION)
+	t.flushInterval = flushInterval
+	t.ctx = ctx
+	t.origins = map[string]*cursorOrigin{}
+	t.pending = map[string]*CursorSummaryRecord{}
+	t.done = make(chan struct{})
+	t.failed = metrics.NewCounter("cursors.failed")
+
+	t.wg.Add(1)
+	go t.flushPeriodically()
+
+	return t
+}
+
+// Track links a getMore to the op that opened its cursor (it inherits its queryHash, shape and plan) and adds the entry
+// to the summary of its cursor. Entries without a cursor are left untouched.
+func (t *CursorTracker) Track(entry *ProfilerEntry) {
+	if entry.CursorID == 0 {
+		return
+	}
+
+	key := fmt.Sprintf("%s/%d", entry.Host, entry.CursorID)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if entry.OP == "getmore" {
+		if origin, ok := t.origins[key]; ok {
+			origin.seenAt = time.Now()
+			if entry.QueryHash == "" {
+				entry.QueryHash = origin.queryHash
+			}
+			if origin.shapeHash != "" {
+				entry.ShapeHash = origin.shapeHash
+			}
+			if entry.PlanHash == "" {
+				entry.PlanHash = origin.planHash
+			}
+			if entry.PlanSummary == "" {
+				entry.PlanSummary = origin.planSummary
+			}
+		}
+	} else {
+		t.origins[key] = &cursorOrigin{
+			queryHash:   entry.QueryHash,
+			shapeHash:   entry.ShapeHash,
+			planHash:    entry.PlanHash,
+			planSummary: entry.PlanSummary,
+			seenAt:      time.Now(),
+		}
+	}
+
+	if entry.CursorExhausted {
+		delete(t.origins, key)
+	}
+
+	summary, ok := t.pending[key]
+	if !ok {
+		summary = &CursorSummaryRecord{
+			ID:         key,
+			Host:       entry.Host,
+			Shard:      entry.Shard,
+			Database:   entry.Database,
+			Collection: entry.Collection,
+			CursorID:   entry.CursorID,
+			FirstSeen:  entry.Timestamp,
+			LastSeen:   entry.Timestamp,
+		}
+		t.pending[key] = summary
+	}
+
+	if summary.QueryHash == "" {
+		summary.QueryHash = entry.StoredQueryHash()
+	}
+	if summary.ShapeHash == "" {
+		summary.ShapeHash = entry.ShapeHash
+	}
+	if summary.PlanSummary == "" {
+		summary.PlanSummary = entry.PlanSummary
+	}
+	if entry.Timestamp.Before(summary.FirstSeen) {
+		summary.FirstSeen = entry.Timestamp
+	}
+	if entry.Timestamp.After(summary.LastSeen) {
+		summary.LastSeen = entry.Timestamp
+	}
+	summary.Batches++
+	summary.DurationMS += entry.DurationMS
+	summary.NReturned += entry.NReturned
+	summary.DocExamined += entry.DocExamined
+	summary.KeysExamined += entry.KeysExamined
+	summary.Exhausted = summary.Exhausted || entry.CursorExhausted
+}
+
+// Flush upserts the pending summaries and forgets the cursors that most likely timed out on the server.
+func (t *CursorTracker) Flush(ctx context.Context) {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = map[string]*CursorSummaryRecord{}
+
+	for key, origin := range t.origins {
+		if time.Since(origin.seenAt) > constant.PROFILER_CURSOR_TIMEOUT {
+			delete(t.origins, key)
+		}
+	}
+	t.lock.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	models := make([]mongo.WriteModel, 0, len(pending))
+	for _, summary := range pending {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": summary.ID}).
+			SetUpdate(summary.update()).
+			SetUpsert(true))
+	}
+
+	opts := options.BulkWrite()
+	opts.SetOrdered(false)
+
+	if _, err := t.collection.BulkWrite(ctx, models, opts); err != nil {
+		t.failed.Add(int64(len(models)))
+		logger.Warn("failed to update %v cursor summaries: %v", len(models), err)
+	}
+}
+
+// Close stops the periodic flush and writes what's still pending.
+func (t *CursorTracker) Close(ctx context.Context) {
+	close(t.done)
+	t.wg.Wait()
+
+	t.Flush(ctx)
+}
+
+func (t *CursorTracker) flushPeriodically() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.Flush(t.ctx)
+		}
+	}
+}
+
+// update merges the delta into the stored summary.
+func (r *CursorSummaryRecord) update() bson.M {
+	set := bson.M{}
+	if r.QueryHash != "" {
+		set["queryHash"] = r.QueryHash
+	}
+	if r.ShapeHash != "" {
+		set["shapeHash"] = r.ShapeHash
+	}
+	if r.PlanSummary != "" {
+		set["planSummary"] = r.PlanSummary
+	}
+	if r.Exhausted {
+		set["exhausted"] = true
+	}
+
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"host":       r.Host,
+			"shard":      r.Shard,
+			"database":   r.Database,
+			"collection": r.Collection,
+			"cursorID":   r.CursorID,
+		},
+		"$min": bson.M{"firstSeen": r.FirstSeen},
+		"$max": bson.M{"lastSeen": r.LastSeen},
+		"$inc": bson.M{
+			"batches":      r.Batches,
+			"durationMS":   r.DurationMS,
+			"nreturned":    r.NReturned,
+			"docsExamined": r.DocExamined,
+			"keysExamined": r.KeysExamined,
+		},
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+
+	return update
+}
@@ -0,0 +1,44 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursorTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker := &CursorTracker{origins: map[string]*cursorOrigin{}, pending: map[string]*CursorSummaryRecord{}}
+	ts := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	find := &ProfilerEntry{OP: "query", Host: "node1:27017", Collection: "app.users", CursorID: 42, Timestamp: ts,
+		QueryHash: "FFF0C0D3", ShapeHash: "0000ABCD", PlanSummary: "IXSCAN { status: 1 }", DurationMS: 150, NReturned: 101}
+	getMore := &ProfilerEntry{OP: "getmore", Host: "node1:27017", Collection: "app.users", CursorID: 42, Timestamp: ts.Add(time.Second),
+		ShapeHash: "0000EEEE", DurationMS: 300, NReturned: 1000, CursorExhausted: true}
+	other := &ProfilerEntry{OP: "getmore", Host: "node2:27017", Collection: "app.users", CursorID: 42, Timestamp: ts, DurationMS: 10}
+
+	tracker.Track(find)
+	tracker.Track(getMore)
+	tracker.Track(other)
+
+	if getMore.QueryHash != "FFF0C0D3" || getMore.ShapeHash != "0000ABCD" || getMore.PlanSummary != "IXSCAN { status: 1 }" {
+		t.Errorf("getMore should inherit from its originating command, got %+v", getMore)
+	}
+	if other.QueryHash != "" {
+		t.Error("cursor ids are local to a node")
+	}
+
+	summary := tracker.pending["node1:27017/42"]
+	if summary == nil {
+		t.Fatal("missing cursor summary")
+	}
+	if summary.Batches != 2 || summary.DurationMS != 450 || summary.NReturned != 1101 || !summary.Exhausted {
+		t.Errorf("unexpected cursor summary %+v", summary)
+	}
+	if !summary.FirstSeen.Equal(ts) || !summary.LastSeen.Equal(ts.Add(time.Second)) {
+		t.Errorf("unexpected cursor lifetime %v - %v", summary.FirstSeen, summary.LastSeen)
+	}
+	if _, ok := tracker.origins["node1:27017/42"]; ok {
+		t.Error("exhausted cursor should be forgotten")
+	}
+}
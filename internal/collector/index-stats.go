@@ -0,0 +1,293 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexStatsRecord is the usage of an index on a node at the time of a snapshot. The server only counts accesses
+// since the node started (or the index was created), so each record also holds the accesses since the previous
+// snapshot of the same index on the same node.
+type IndexStatsRecord struct {
+	Timestamp  time.Time `bson:"timestamp"`
+	Host       string    `bson:"host"`
+	Shard      string    `bson:"shard,omitempty"`
+	Database   string    `bson:"database"`
+	Collection string    `bson:"collection"`
+	Name       string    `bson:"name"`
+	Key        bson.Raw  `bson:"key"`
+	Ops        int64     `bson:"ops"`                // accesses.ops
+	Since      time.Time `bson:"since"`              // accesses.since, when the server started counting
+	OpsDelta   *int64    `bson:"opsDelta,omitempty"` // Unknown for the first snapshot of an index
+	Reset      bool      `bson:"reset,omitempty"`    // Counters were reset since the previous snapshot (restart, index rebuilt...)
+}
+
+// indexStats is the part of an $indexStats document we read.
+type indexStats struct {
+	Name     string   `bson:"name"`
+	Key      bson.Raw `bson:"key"`
+	Host     string   `bson:"host"`
+	Shard    string   `bson:"shard"`
+	Accesses struct {
+		Ops   int64     `bson:"ops"`
+		Since time.Time `bson:"since"`
+	} `bson:"accesses"`
+}
+
+type IndexStatsOptions struct {
+	Interval  time.Duration // Time between two snapshots
+	Databases []string      // Same as CollectorOptions.Databases
+}
+
+// IndexStatsSnapshotter runs $indexStats on every collection of the listened databases at every interval and stores
+// the snapshots, so that index usage can be compared across time.
+type IndexStatsSnapshotter struct {
+	client     *mgo.Client
+	collection *mongo.Collection
+	opts       IndexStatsOptions
+	ctx        context.Context
+
+	lock     sync.Mutex
+	previous map[string]*IndexStatsRecord // <host>/<namespace>/<index>
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	failed *metrics.Counter
+}
+
+func InitIndexStatsCollection(ctx context.Context, db *mongo.Database) error {
+	if err := db.CreateCollection(ctx, constant.PROFILER_INDEXSTATS_COLLECTION); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	collection := db.Collection(constant.PROFILER_INDEXSTATS_COLLECTION)
+
+	options := options.Index()
+	options.SetExpireAfterSeconds(constant.PROFILER_INDEXSTATS_EXPIRE_SECONDS)
+
+	_, err := collection.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.M{"timestamp": 1},
+				Options: options,
+			},
+			{
+				Keys: bson.D{{Key: "host", Value: 1}, {Key: "collection", Value: 1}, {Key: "name", Value: 1}, {Key: "timestamp", Value: -1}},
+			},
+		},
+	)
+	if err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_INDEX_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewIndexStatsSnapshotter(ctx context.Context, client *mgo.Client, db *mongo.Database, opts IndexStatsOptions) *IndexStatsSnapshotter {
+	s := &IndexStatsSnapshotter{}
+	s.client = client
+	s.collection = db.Collection(constant.PROFILER_INDEXSTATS_COLLECTION)
+	s.opts = opts
+	s.ctx = ctx
+	s.previous = map[string]*IndexStatsRecord{}
+	s.done = make(chan struct{})
+	s.failed = metrics.NewCounter("indexstats.failed")
+
+	s.wg.Add(1)
+	go s.snapshotPeriodically()
+
+	return s
+}
+
+// Snapshot stores the index stats of every collection. A collection failing doesn't prevent the other ones from
+// being snapshotted.
+func (s *IndexStatsSnapshotter) Snapshot(ctx context.Context) error {
+	databases, err := listDatabases(ctx, s.client, s.opts.Databases)
+	if err != nil {
+		return fmt.Errorf("failed to list databases of Mongo host %s: %w", s.client.Connstr.Hosts, err)
+	}
+
+	now := time.Now()
+	errs := []string{}
+
+	for _, database := range databases {
+		collections, err := s.client.C.Database(database).ListCollectionNames(ctx, bson.M{"type": "collection"}) // $indexStats fails on views
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to list collections of %s: %v", database, err))
+			continue
+		}
+
+		for _, collection := range collections {
+			if strings.HasPrefix(collection, "system.") {
+				continue
+			}
+
+			if err := s.snapshotCollection(ctx, database, collection, now); err != nil {
+				s.failed.Inc()
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Close stops the periodic snapshots.
+func (s *IndexStatsSnapshotter) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *IndexStatsSnapshotter) snapshotPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Snapshot(s.ctx); err != nil {
+				logger.Warn("%v", err)
+			}
+		}
+	}
+}
+
+func (s *IndexStatsSnapshotter) snapshotCollection(ctx context.Context, database, collection string, now time.Time) error {
+	ns := fmt.Sprintf("%s.%s", database, collection)
+
+	cursor, err := s.client.C.Database(database).Collection(collection).Aggregate(ctx, mongo.Pipeline{{{Key: "$indexStats", Value: bson.D{}}}})
+	if err != nil {
+		return fmt.Errorf("failed to run $indexStats on %s: %w", ns, err)
+	}
+	defer cursor.Close(ctx)
+
+	records := []interface{}{}
+	for cursor.Next(ctx) {
+		stats := &indexStats{}
+		if err := cursor.Decode(stats); err != nil {
+			return fmt.Errorf("failed to decode $indexStats document of %s: %w", ns, err)
+		}
+
+		record := &IndexStatsRecord{
+			Timestamp:  now,
+			Host:       stats.Host,
+			Shard:      stats.Shard,
+			Database:   database,
+			Collection: ns,
+			Name:       stats.Name,
+			Key:        stats.Key,
+			Ops:        stats.Accesses.Ops,
+			Since:      stats.Accesses.Since,
+		}
+
+		previous, err := s.previousRecord(ctx, record)
+		if err != nil {
+			logger.Warn("%v", err) // The delta will be unknown for this snapshot only
+		}
+		record.diff(previous)
+
+		records = append(records, record)
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to read $indexStats of %s: %w", ns, err)
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	if _, err := s.collection.InsertMany(ctx, records); err != nil {
+		return fmt.Errorf("failed to store index stats of %s: %w", ns, err)
+	}
+
+	s.lock.Lock()
+	for _, record := range records {
+		record := record.(*IndexStatsRecord)
+		s.previous[record.key()] = record
+	}
+	s.lock.Unlock()
+
+	return nil
+}
+
+// previousRecord returns the last snapshot of the same index on the same node, looking it up in the internal
+// database after a restart of the collector.
+func (s *IndexStatsSnapshotter) previousRecord(ctx context.Context, record *IndexStatsRecord) (*IndexStatsRecord, error) {
+	s.lock.Lock()
+	previous, ok := s.previous[record.key()]
+	s.lock.Unlock()
+
+	if ok {
+		return previous, nil
+	}
+
+	previous = &IndexStatsRecord{}
+	err := s.collection.FindOne(
+		ctx,
+		bson.M{"host": record.Host, "collection": record.Collection, "name": record.Name},
+		options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}}),
+	).Decode(previous)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find previous index stats of %s on %s: %w", record.Collection, record.Host, err)
+	}
+
+	return previous, nil
+}
+
+func (r *IndexStatsRecord) key() string {
+	return fmt.Sprintf("%s/%s/%s", r.Host, r.Collection, r.Name)
+}
+
+// diff sets the accesses since the previous snapshot. Counters restart from zero when the node restarts or the index
+// is rebuilt, which changes accesses.since (or at least makes the count decrease): every access counted since then
+// happened after the previous snapshot.
+func (r *IndexStatsRecord) diff(previous *IndexStatsRecord) {
+	if previous == nil {
+		return
+	}
+
+	delta := r.Ops - previous.Ops
+	if !r.Since.Equal(previous.Since) || delta < 0 {
+		delta = r.Ops
+		r.Reset = true
+	}
+
+	r.OpsDelta = &delta
+}
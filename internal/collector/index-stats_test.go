@@ -0,0 +1,41 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIndexStatsDiff(t *testing.T) {
+	t.Parallel()
+
+	started := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	restarted := started.Add(36 * time.Hour)
+	previous := &IndexStatsRecord{Ops: 1200, Since: started}
+
+	for _, tc := range []struct {
+		name  string
+		ops   int64
+		since time.Time
+		delta int64
+		reset bool
+	}{
+		{"same node", 1500, started, 300, false},
+		{"unused", 1200, started, 0, false},
+		{"restarted", 40, restarted, 40, true},
+		{"restarted with more accesses", 5000, restarted, 5000, true},
+		{"count decreased", 100, started, 100, true},
+	} {
+		record := &IndexStatsRecord{Ops: tc.ops, Since: tc.since}
+		record.diff(previous)
+
+		if record.OpsDelta == nil || *record.OpsDelta != tc.delta || record.Reset != tc.reset {
+			t.Errorf("%s: expected a delta of %v (reset: %v), got %+v", tc.name, tc.delta, tc.reset, record)
+		}
+	}
+
+	first := &IndexStatsRecord{Ops: 1200, Since: started}
+	first.diff(nil)
+	if first.OpsDelta != nil {
+		t.Errorf("expected no delta for the first snapshot, got %v", *first.OpsDelta)
+	}
+}
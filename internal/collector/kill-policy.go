@@ -0,0 +1,324 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KillRule selects the running operations to kill. Every condition must match, empty ones match everything except
+// After which is mandatory.
+type KillRule struct {
+	Spec      string        // As written by the user, kept in the audit
+	Namespace string        // e.g. "app.users" or "app.*"
+	User      string        // e.g. "reporting@admin"
+	CollScan  bool          // Only operations running without index
+	After     time.Duration // Only operations running for longer
+}
+
+type KillPolicy struct {
+	Rules           []KillRule // First matching rule wins
+	AllowedAppNames []string   // Operations of these applications are never killed
+	DryRun          bool       // Only log and audit what would have been killed
+}
+
+// KillAuditRecord keeps every kill decision, real or not. There is one record per operation, retries update it.
+type KillAuditRecord struct {
+	Timestamp   time.Time   `bson:"timestamp"`
+	CurrentOpID string      `bson:"currentOpID"` // _id of the operation in currentops
+	OpID        interface{} `bson:"opid"`
+	Host        string      `bson:"host"`
+	Shard       string      `bson:"shard,omitempty"`
+	Collection  string      `bson:"collection,omitempty"`
+	User        string      `bson:"user,omitempty"`
+	AppName     string      `bson:"appName,omitempty"`
+	QueryHash   string      `bson:"queryHash,omitempty"`
+	PlanSummary string      `bson:"planSummary,omitempty"`
+	DurationMS  int64       `bson:"durationMS"`
+	Rule        string      `bson:"rule"`
+	DryRun      bool        `bson:"dryRun"`
+	Killed      bool        `bson:"killed"` // Requested kills are confirmed once the operation is gone
+	Error       string      `bson:"error,omitempty"`
+}
+
+// Killer runs killOp on the operations matching the policy, and records each decision in the audit collection.
+type Killer struct {
+	client *mgo.Client
+	audit  *mongo.Collection
+	policy KillPolicy
+
+	killed *metrics.Counter
+	failed *metrics.Counter
+}
+
+// ParseKillRules reads rules formatted as comma separated conditions (ns=<pattern>, user=<user>, collscan and
+// after=<duration>) separated by semicolons, e.g. "ns=app.*,collscan,after=30s;user=reporting@admin,after=10m".
+func ParseKillRules(s string) ([]KillRule, error) {
+	rules := []KillRule{}
+
+	for _, spec := range strings.Split(s, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		rule := KillRule{Spec: spec}
+		for _, condition := range strings.Split(spec, ",") {
+			key, value, hasValue := strings.Cut(strings.TrimSpace(condition), "=")
+			if key == "collscan" && hasValue {
+				return nil, fmt.Errorf("collscan takes no value in kill rule %q", spec)
+			}
+			if key != "collscan" && value == "" {
+				return nil, fmt.Errorf("condition %q in kill rule %q needs a value", condition, spec)
+			}
+
+			switch key {
+			case "ns":
+				if _, err := path.Match(value, ""); err != nil {
+					return nil, fmt.Errorf("invalid namespace pattern %q: %w", value, err)
+				}
+				rule.Namespace = value
+			case "user":
+				rule.User = value
+			case "collscan":
+				rule.CollScan = true
+			case "after":
+				after, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid duration in kill rule %q: %w", spec, err)
+				}
+				rule.After = after
+			default:
+				return nil, fmt.Errorf("unknown condition %q in kill rule %q (expected ns, user, collscan or after)", condition, spec)
+			}
+		}
+
+		if rule.After <= 0 { // Never kill an operation as soon as it starts
+			return nil, fmt.Errorf("kill rule %q must set a running time (e.g. after=30s)", spec)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func InitKillAuditCollection(ctx context.Context, db *mongo.Database) error {
+	if err := db.CreateCollection(ctx, constant.PROFILER_KILL_AUDIT_COLLECTION); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	collection := db.Collection(constant.PROFILER_KILL_AUDIT_COLLECTION)
+
+	options := options.Index()
+	options.SetExpireAfterSeconds(constant.PROFILER_SLOWOPS_EXPIRE_SECONDS)
+
+	_, err := collection.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.M{"timestamp": 1},
+				Options: options,
+			},
+			{
+				Keys: bson.M{"currentOpID": 1},
+			},
+		},
+	)
+	if err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_INDEX_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewKiller(client *mgo.Client, db *mongo.Database, policy KillPolicy) *Killer {
+	k := &Killer{}
+	k.client = client
+	k.audit = db.Collection(constant.PROFILER_KILL_AUDIT_COLLECTION)
+	k.policy = policy
+	k.killed = metrics.NewCounter("kills.killed")
+	k.failed = metrics.NewCounter("kills.failed")
+
+	return k
+}
+
+// Match returns the first rule matching the operation, unless its application is allowed.
+func (p *KillPolicy) Match(record *CurrentOpRecord) (KillRule, bool) {
+	for _, appName := range p.AllowedAppNames {
+		if record.AppName == appName {
+			return KillRule{}, false
+		}
+	}
+
+	for _, rule := range p.Rules {
+		if rule.matches(record) {
+			return rule, true
+		}
+	}
+
+	return KillRule{}, false
+}
+
+func (rule KillRule) matches(record *CurrentOpRecord) bool {
+	if rule.Namespace != "" {
+		if matched, _ := path.Match(rule.Namespace, record.Collection); !matched {
+			return false
+		}
+	}
+	if rule.User != "" && rule.User != record.User {
+		return false
+	}
+	if rule.CollScan && record.PlanSummary != constant.PROFILER_COLLSCAN_PLAN_SUMMARY { // Same as the collscan report
+		return false
+	}
+
+	return time.Duration(record.DurationMS)*time.Millisecond >= rule.After
+}
+
+// killState is what the killer remembers of an operation between two checks.
+type killState struct {
+	auditID   interface{} // Audit of the kill we requested, confirmed once the operation is gone
+	wouldKill bool        // Matched the kill policy in dry-run mode
+	failures  int         // Consecutive failed kills, only the first one is audited
+	retryAt   time.Time
+}
+
+// Check requests the kill of the operation when it matches the policy. killOp succeeds even when no operation has the
+// opid, so the kill is only audited as requested, and confirmed by Confirm once the operation is gone. In dry-run mode,
+// an operation is only audited the first time it matches.
+func (k *Killer) Check(ctx context.Context, record *CurrentOpRecord) {
+	if record.KillRule != "" {
+		if record.killPending {
+			return // Being killed
+		}
+
+		k.failedKill(ctx, record, record.KillRule, errors.New("operation still running without being killed after killOp"))
+		record.KillRule = ""
+		return
+	}
+
+	if (k.policy.DryRun && record.kill.wouldKill) || time.Now().Before(record.kill.retryAt) {
+		return
+	}
+
+	rule, ok := k.policy.Match(record)
+	if !ok {
+		return
+	}
+
+	if k.policy.DryRun {
+		record.kill.wouldKill = true
+		logger.Info("would kill op %v on %s (%s, running for %vms) matching rule %q", record.OpID, record.Host, record.Collection, record.DurationMS, rule.Spec)
+		k.insertAudit(ctx, newKillAuditRecord(record, rule.Spec, true))
+		return
+	}
+
+	if err := k.kill(ctx, record.OpID); err != nil {
+		k.failedKill(ctx, record, rule.Spec, err)
+		return
+	}
+
+	record.KillRule = rule.Spec
+	if record.kill.auditID == nil { // Retries keep the audit of the first attempt
+		record.kill.auditID = k.insertAudit(ctx, newKillAuditRecord(record, rule.Spec, false))
+	}
+	logger.Info("requested kill of op %v on %s (%s, running for %vms) matching rule %q", record.OpID, record.Host, record.Collection, record.DurationMS, rule.Spec)
+}
+
+// Confirm records that an operation we requested the kill of is gone.
+func (k *Killer) Confirm(ctx context.Context, record *CurrentOpRecord) {
+	k.killed.Inc()
+	logger.Info("killed op %v on %s (%s) matching rule %q", record.OpID, record.Host, record.Collection, record.KillRule)
+
+	if record.kill.auditID == nil {
+		return
+	}
+	update := bson.M{"$set": bson.M{"killed": true}, "$unset": bson.M{"error": ""}} // Killed by a retry
+	if _, err := k.audit.UpdateByID(ctx, record.kill.auditID, update); err != nil {
+		logger.Warn("failed to audit kill of op %v: %v", record.OpID, err)
+	}
+}
+
+// failedKill waits longer after each failure before trying again. Only the first failure of an operation is logged
+// and audited, so that an operation we can't kill doesn't flood the audit.
+func (k *Killer) failedKill(ctx context.Context, record *CurrentOpRecord, rule string, err error) {
+	k.failed.Inc()
+	record.kill.failures++
+	record.kill.retryAt = time.Now().Add(retryAfter(record.kill.failures))
+
+	if record.kill.failures > 1 {
+		return
+	}
+
+	logger.Warn("failed to kill op %v on %s matching rule %q, retrying in %v: %v", record.OpID, record.Host, rule, retryAfter(1), err)
+
+	if record.kill.auditID != nil {
+		if _, err := k.audit.UpdateByID(ctx, record.kill.auditID, bson.M{"$set": bson.M{"error": err.Error()}}); err != nil {
+			logger.Warn("failed to audit kill of op %v: %v", record.OpID, err)
+		}
+		return
+	}
+
+	audit := newKillAuditRecord(record, rule, false)
+	audit.Error = err.Error()
+	record.kill.auditID = k.insertAudit(ctx, audit)
+}
+
+// insertAudit returns the _id of the audit record, nil when it couldn't be stored.
+func (k *Killer) insertAudit(ctx context.Context, audit *KillAuditRecord) interface{} {
+	res, err := k.audit.InsertOne(ctx, audit)
+	if err != nil {
+		logger.Warn("failed to audit kill decision for op %v: %v", audit.OpID, err)
+		return nil
+	}
+
+	return res.InsertedID
+}
+
+func newKillAuditRecord(record *CurrentOpRecord, rule string, dryRun bool) *KillAuditRecord {
+	return &KillAuditRecord{
+		Timestamp:   time.Now(),
+		CurrentOpID: record.ID,
+		OpID:        record.OpID,
+		Host:        record.Host,
+		Shard:       record.Shard,
+		Collection:  record.Collection,
+		User:        record.User,
+		AppName:     record.AppName,
+		QueryHash:   record.QueryHash,
+		PlanSummary: record.PlanSummary,
+		DurationMS:  record.DurationMS,
+		Rule:        rule,
+		DryRun:      dryRun,
+	}
+}
+
+func (k *Killer) kill(ctx context.Context, opID interface{}) error {
+	res := k.client.C.Database("admin").RunCommand(ctx, bson.D{{Key: "killOp", Value: 1}, {Key: "op", Value: opID}})
+
+	return res.Err()
+}
@@ -0,0 +1,75 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseKillRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := ParseKillRules("ns=app.*,collscan,after=30s; user=reporting@admin,after=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %v", rules)
+	}
+	if rules[0].Namespace != "app.*" || !rules[0].CollScan || rules[0].After != 30*time.Second {
+		t.Errorf("unexpected first rule %+v", rules[0])
+	}
+	if rules[1].User != "reporting@admin" || rules[1].CollScan || rules[1].After != 10*time.Minute {
+		t.Errorf("unexpected second rule %+v", rules[1])
+	}
+
+	for _, invalid := range []string{"ns=app.*", "after=soon", "plan=COLLSCAN,after=1s", "ns=[,after=1s", "collscan=false,after=1s", "ns=,after=1s", "user,after=1s"} {
+		if _, err := ParseKillRules(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestKillPolicyMatch(t *testing.T) {
+	t.Parallel()
+
+	rules, err := ParseKillRules("ns=app.*,collscan,after=30s;user=reporting@admin,after=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &KillPolicy{Rules: rules, AllowedAppNames: []string{"backup"}}
+
+	for _, tc := range []struct {
+		record CurrentOpRecord
+		rule   string
+	}{
+		{CurrentOpRecord{Collection: "app.users", PlanSummary: "COLLSCAN", DurationMS: 45000}, rules[0].Spec},
+		{CurrentOpRecord{Collection: "app.users", PlanSummary: "COLLSCAN", DurationMS: 45000, AppName: "backup"}, ""},
+		{CurrentOpRecord{Collection: "app.users", PlanSummary: "IXSCAN { email: 1 }", DurationMS: 45000}, ""},
+		{CurrentOpRecord{Collection: "app.users", PlanSummary: "IXSCAN { email: 1 }, COLLSCAN", DurationMS: 45000}, ""},
+		{CurrentOpRecord{Collection: "app.users", PlanSummary: "COLLSCAN", DurationMS: 20000}, ""},
+		{CurrentOpRecord{Collection: "logs.events", User: "reporting@admin", DurationMS: 900000}, rules[1].Spec},
+		{CurrentOpRecord{Collection: "logs.events", User: "app@admin", DurationMS: 900000}, ""},
+	} {
+		rule, ok := policy.Match(&tc.record)
+		if ok != (tc.rule != "") || rule.Spec != tc.rule {
+			t.Errorf("%+v: expected rule %q, got %q", tc.record, tc.rule, rule.Spec)
+		}
+	}
+}
+
+func TestKillRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	for failures, expected := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		6:  5 * time.Minute,
+		50: 5 * time.Minute,
+	} {
+		if wait := retryAfter(failures); wait != expected {
+			t.Errorf("expected to wait %v after %v failures, got %v", expected, failures, wait)
+		}
+	}
+}
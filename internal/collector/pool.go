@@ -0,0 +1,176 @@
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// QueuePolicy defines what happens when profile entries arrive faster than the workers can handle them.
+type QueuePolicy string
+
+const (
+	QueueBlock      QueuePolicy = "block"       // Stop reading system.profile until a worker is available
+	QueueDropOldest QueuePolicy = "drop-oldest" // Discard the oldest queued entry to make room
+	QueueDropNewest QueuePolicy = "drop-newest" // Discard the entry that was just read
+)
+
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch policy := QueuePolicy(s); policy {
+	case QueueBlock, QueueDropOldest, QueueDropNewest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown queue policy %q (expected %s, %s or %s)", s, QueueBlock, QueueDropOldest, QueueDropNewest)
+}
+
+var (
+	queuedEntries  = metrics.NewCounter("collector.queue.queued")
+	droppedEntries = metrics.NewCounter("collector.queue.dropped")
+	failedEntries  = metrics.NewCounter("collector.handler.failed")
+)
+
+type job struct {
+	source Source
+	data   bson.Raw
+}
+
+// pool runs the handler on a fixed number of workers fed by a bounded queue, so that a busy cluster can't make us
+// spawn an unbounded number of goroutines.
+//
+// Entries of the same cursor always go to the same worker, so that they are handled in the order they were read: a
+// getMore must be handled after the op that opened its cursor to inherit its queryHash.
+type pool struct {
+	handler Handler
+	workers int
+	policy  QueuePolicy
+	queue   chan job   // Entries without a cursor, handled by any worker
+	cursors []chan job // Entries with a cursor, one queue per worker
+	wg      sync.WaitGroup
+}
+
+func newPool(handler Handler, workers int, queueSize int, policy QueuePolicy) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if policy == "" {
+		policy = QueueBlock
+	}
+
+	p := &pool{}
+	p.handler = handler
+	p.workers = workers
+	p.policy = policy
+	p.queue = make(chan job, queueSize)
+
+	cursorQueueSize := queueSize / workers
+	if queueSize > 0 && cursorQueueSize < 1 {
+		cursorQueueSize = 1
+	}
+	for i := 0; i < workers; i++ {
+		p.cursors = append(p.cursors, make(chan job, cursorQueueSize))
+	}
+
+	return p
+}
+
+func (p *pool) start(ctx context.Context) {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go func(queue, cursor chan job) {
+			defer p.wg.Done()
+
+			for queue != nil || cursor != nil {
+				var j job
+				var ok bool
+
+				select {
+				case j, ok = <-queue:
+					if !ok {
+						queue = nil
+						continue
+					}
+				case j, ok = <-cursor:
+					if !ok {
+						cursor = nil
+						continue
+					}
+				}
+
+				if err := p.handler(ctx, j.source, j.data); err != nil {
+					failedEntries.Inc()
+				}
+			}
+		}(p.queue, p.cursors[i])
+	}
+}
+
+// submit queues a copy of data: the driver reuses the cursor buffer on the next call to TryNext.
+func (p *pool) submit(ctx context.Context, source Source, data bson.Raw) {
+	j := job{source: source, data: append(bson.Raw(nil), data...)}
+
+	queue := p.queue
+	if cursorID, ok := data.Lookup("cursorid").Int64OK(); ok && cursorID != 0 {
+		queue = p.cursors[cursorWorker(source.Host, cursorID, len(p.cursors))]
+	}
+
+	switch p.policy {
+	case QueueBlock:
+		select {
+		case queue <- j:
+		case <-ctx.Done():
+			droppedEntries.Inc()
+			return
+		}
+	case QueueDropNewest:
+		select {
+		case queue <- j:
+		default:
+			droppedEntries.Inc()
+			return
+		}
+	case QueueDropOldest:
+		for queued := false; !queued; {
+			select {
+			case queue <- j:
+				queued = true
+			default:
+				select {
+				case <-queue:
+					droppedEntries.Inc()
+				default:
+				}
+			}
+		}
+	}
+
+	queuedEntries.Inc()
+}
+
+// close waits for the queued entries to be handled. Nothing can be submitted afterwards.
+func (p *pool) close() {
+	close(p.queue)
+	for _, cursor := range p.cursors {
+		close(cursor)
+	}
+	p.wg.Wait()
+
+	if dropped := droppedEntries.Value(); dropped > 0 {
+		logger.Warn("%v profile entries were dropped because the queue was full", dropped)
+	}
+}
+
+// cursorWorker picks the worker handling every entry of a cursor.
+func cursorWorker(host string, cursorID int64, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	binary.Write(h, binary.LittleEndian, cursorID)
+
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,103 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPoolPolicies(t *testing.T) {
+	first, _ := bson.Marshal(bson.M{"n": 1})
+	second, _ := bson.Marshal(bson.M{"n": 2})
+
+	tests := []struct {
+		policy   QueuePolicy
+		expected int32
+	}{
+		{QueueDropNewest, 1},
+		{QueueDropOldest, 2},
+	}
+
+	for _, test := range tests {
+		p := newPool(nil, 1, 1, test.policy) // workers are not started so the queue stays full
+		dropped := droppedEntries.Value()
+
+		p.submit(context.Background(), Source{}, first)
+		p.submit(context.Background(), Source{}, second)
+
+		if droppedEntries.Value()-dropped != 1 {
+			t.Errorf("%s: expected 1 dropped entry, got %v", test.policy, droppedEntries.Value()-dropped)
+		}
+
+		j := <-p.queue
+		if n := j.data.Lookup("n").Int32(); n != test.expected {
+			t.Errorf("%s: expected entry %v to be queued, got %v", test.policy, test.expected, n)
+		}
+	}
+}
+
+func TestPoolCopiesData(t *testing.T) {
+	data, _ := bson.Marshal(bson.M{"n": 1})
+
+	p := newPool(nil, 1, 1, QueueBlock)
+	p.submit(context.Background(), Source{}, data)
+
+	data[len(data)-2] = 42 // The driver reuses the cursor buffer
+
+	if n := (<-p.queue).data.Lookup("n").Int32(); n != 1 {
+		t.Errorf("expected queued entry to be a copy, got %v", n)
+	}
+}
+
+// A getMore read right after its find must not overtake it, even when another worker is free.
+func TestPoolKeepsCursorOrder(t *testing.T) {
+	find, _ := bson.Marshal(bson.D{
+		{Key: "op", Value: "query"}, {Key: "ns", Value: "app.users"}, {Key: "cursorid", Value: int64(42)},
+		{Key: "queryHash", Value: "FFF0C0D3"}, {Key: "command", Value: bson.D{{Key: "find", Value: "users"}}},
+	})
+	getMore, _ := bson.Marshal(bson.D{
+		{Key: "op", Value: "getmore"}, {Key: "ns", Value: "app.users"}, {Key: "cursorid", Value: int64(42)},
+		{Key: "originatingCommand", Value: bson.D{{Key: "find", Value: "users"}}},
+	})
+
+	tracker := &CursorTracker{origins: map[string]*cursorOrigin{}, pending: map[string]*CursorSummaryRecord{}}
+	release := make(chan struct{})
+
+	var lock sync.Mutex
+	var handled *ProfilerEntry
+
+	p := newPool(func(ctx context.Context, source Source, data bson.Raw) error {
+		entry, err := NewProfilerEntry(source, data)
+		if err != nil {
+			return err
+		}
+
+		if entry.OP == "query" {
+			<-release // The find takes a while, the getMore arrives first at the other workers
+		}
+		tracker.Track(entry)
+
+		if entry.OP == "getmore" {
+			lock.Lock()
+			handled = entry
+			lock.Unlock()
+		}
+
+		return nil
+	}, 4, 10, QueueBlock)
+	p.start(context.Background())
+
+	p.submit(context.Background(), Source{Host: "node1:27017"}, find)
+	p.submit(context.Background(), Source{Host: "node1:27017"}, getMore)
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	p.close()
+
+	if handled == nil || handled.QueryHash != "FFF0C0D3" {
+		t.Errorf("expected the getMore to inherit the queryHash of its find, got %+v", handled)
+	}
+}
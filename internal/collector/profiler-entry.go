@@ -2,38 +2,68 @@ package collector
 
 import (
 	"fmt"
-	"strconv"
+	"net"
 	"strings"
 	"time"
 
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/redact"
+	"github.com/guillotjulien/mongo-profiler/internal/shape"
 	"github.com/guillotjulien/mongo-profiler/internal/utils/murmur3"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsonrw"
 )
 
 type ProfilerEntry struct {
-	Timestamp      time.Time `bson:"ts,omitempty"`
-	OP             string    `bson:"op,omitempty"`
-	Collection     string    `bson:"ns,omitempty"`
-	User           string    `bson:"user,omitempty"`
-	ResponseLength int       `bson:"responseLength,omitempty"`
-	DurationMS     int       `bson:"millis,omitempty"`
-	CursorID       int64     `bson:"cursorid,omitempty"`
-	KeysExamined   int       `bson:"keysExamined,omitempty"`
-	DocExamined    int       `bson:"docsExamined,omitempty"`
-	HasSortStage   bool      `bson:"hasSortStage,omitempty"`
-	NReturned      int       `bson:"nreturned,omitempty"`
-	NDeleted       int       `bson:"ndeleted,omitempty"`
-	NInserted      int       `bson:"ninserted,omitempty"`
-	NModified      int       `bson:"nmodified,omitempty"`
-	QueryHash      string    `bson:"queryHash,omitempty"`
-	PlanHash       string    `bson:"planCacheKey,omitempty"`
-	PlanSummary    string    `bson:"planSummary,omitempty"`
-	Host           string
-	Document       bson.Raw
+	Timestamp       time.Time `bson:"ts,omitempty"`
+	OP              string    `bson:"op,omitempty"`
+	Collection      string    `bson:"ns,omitempty"`
+	User            string    `bson:"user,omitempty"`
+	ResponseLength  int       `bson:"responseLength,omitempty"`
+	DurationMS      int       `bson:"millis,omitempty"`
+	CursorID        int64     `bson:"cursorid,omitempty"`
+	CursorExhausted bool      `bson:"cursorExhausted,omitempty"`
+	KeysExamined    int       `bson:"keysExamined,omitempty"`
+	DocExamined     int       `bson:"docsExamined,omitempty"`
+	HasSortStage    bool      `bson:"hasSortStage,omitempty"`
+	NReturned       int       `bson:"nreturned,omitempty"`
+	NDeleted        int       `bson:"ndeleted,omitempty"`
+	NInserted       int       `bson:"ninserted,omitempty"`
+	NModified       int       `bson:"nmodified,omitempty"`
+	QueryHash       string    `bson:"queryHash,omitempty"`
+	PlanHash        string    `bson:"planCacheKey,omitempty"`
+	PlanSummary     string    `bson:"planSummary,omitempty"`
+
+	PlanningTimeMicros int64                `bson:"planningTimeMicros,omitempty"`
+	CPUNanos           int64                `bson:"cpuNanos,omitempty"`
+	NumYield           int                  `bson:"numYield,omitempty"`
+	WriteConflicts     int                  `bson:"writeConflicts,omitempty"`
+	KeysInserted       int                  `bson:"keysInserted,omitempty"`
+	KeysDeleted        int                  `bson:"keysDeleted,omitempty"`
+	Replanned          bool                 `bson:"replanned,omitempty"`
+	ReplanReason       string               `bson:"replanReason,omitempty"`
+	ErrCode            int                  `bson:"errCode,omitempty"`
+	ErrName            string               `bson:"errName,omitempty"`
+	QueryFramework     string               `bson:"queryFramework,omitempty"`
+	PlanCacheShapeHash string               `bson:"planCacheShapeHash,omitempty"`
+	Locks              map[string]LockStats `bson:"locks,omitempty"`
+	Storage            *StorageStats        `bson:"storage,omitempty"`
+	FlowControl        *FlowControlStats    `bson:"flowControl,omitempty"`
+
+	AppName        string          `bson:"appName,omitempty"`
+	Client         string          `bson:"client,omitempty"`
+	ClientMetadata *ClientMetadata `bson:"clientMetadata,omitempty"`
+	Comment        string          `bson:"-"`
+
+	Host      string
+	Shard     string
+	Database  string
+	Document  bson.Raw
+	Shape     bson.D `bson:"-"`
+	ShapeHash string `bson:"-"`
 }
 
-func NewProfilerEntry(host string, data bson.Raw) (entry *ProfilerEntry, err error) {
+func NewProfilerEntry(source Source, data bson.Raw) (entry *ProfilerEntry, err error) {
 	r, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(data))
 	if err != nil {
 		return nil, err
@@ -43,19 +73,36 @@ func NewProfilerEntry(host string, data bson.Raw) (entry *ProfilerEntry, err err
 		return nil, err
 	}
 
-	entry.Host = host
-	entry.Document = data
+	entry.Host = source.Host
+	entry.Shard = source.Shard
+	entry.Document = data // Read by comment() and shape(), must be set first
+	entry.Database, _, _ = strings.Cut(entry.Collection, ".")
+	entry.Client = clientHost(entry.Client)
+	entry.Comment = entry.comment()
+	if entry.AppName == "" && entry.ClientMetadata != nil {
+		entry.AppName = entry.ClientMetadata.Application.Name
+	}
+	entry.Shape = entry.shape()
+	entry.ShapeHash = shape.Hash(entry.Shape)
 
 	return entry, nil
 }
 
 func (entry *ProfilerEntry) ToSlowOpsRecord() *SlowOpsRecord {
 	return &SlowOpsRecord{
+		ID:             entry.recordID(),
+		SchemaVersion:  constant.PROFILER_SLOWOPS_SCHEMA_VERSION,
 		Host:           entry.Host,
+		Shard:          entry.Shard,
+		Database:       entry.Database,
 		Timestamp:      entry.Timestamp,
 		OP:             entry.OP,
 		Collection:     entry.Collection,
 		User:           entry.User,
+		AppName:        entry.AppName,
+		Client:         entry.Client,
+		ClientMetadata: entry.ClientMetadata,
+		Comment:        entry.Comment,
 		ResponseLength: entry.ResponseLength,
 		DurationMS:     entry.DurationMS,
 		CursorID:       entry.CursorID,
@@ -66,43 +113,126 @@ func (entry *ProfilerEntry) ToSlowOpsRecord() *SlowOpsRecord {
 		NDeleted:       entry.NDeleted,
 		NInserted:      entry.NInserted,
 		NModified:      entry.NModified,
-		QueryHash:      entry.queryHash(),
+		QueryHash:      entry.StoredQueryHash(),
+		ShapeHash:      entry.ShapeHash,
 		PlanHash:       entry.PlanHash,
 		PlanSummary:    entry.PlanSummary,
+
+		PlanningTimeMicros: entry.PlanningTimeMicros,
+		CPUNanos:           entry.CPUNanos,
+		NumYield:           entry.NumYield,
+		WriteConflicts:     entry.WriteConflicts,
+		KeysInserted:       entry.KeysInserted,
+		KeysDeleted:        entry.KeysDeleted,
+		Replanned:          entry.Replanned,
+		ReplanReason:       entry.ReplanReason,
+		ErrCode:            entry.ErrCode,
+		ErrName:            entry.ErrName,
+		QueryFramework:     entry.QueryFramework,
+		PlanCacheShapeHash: entry.PlanCacheShapeHash,
+		Locks:              entry.Locks,
+		LockWaitMicros:     lockWaitMicros(entry.Locks),
+		Storage:            entry.Storage,
+		FlowControl:        entry.FlowControl,
 	}
 }
 
-func (entry *ProfilerEntry) ToSlowOpsExampleRecord() *SlowOpsExampleRecord {
+// ToSlowOpsExampleRecord keeps the entry as an example of its query shape, with literals redacted according to the
+// redactor (kept as is when nil).
+func (entry *ProfilerEntry) ToSlowOpsExampleRecord(redactor *redact.Redactor) (*SlowOpsExampleRecord, error) {
+	document, err := redactor.Redact(entry.Collection, entry.Document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact example of %s: %w", entry.Collection, err)
+	}
+
 	return &SlowOpsExampleRecord{
-		QueryHash:   entry.queryHash(),
+		QueryHash:   entry.StoredQueryHash(),
+		ShapeHash:   entry.ShapeHash,
 		Collection:  entry.Collection,
 		PlanHash:    entry.PlanHash,
 		PlanSummary: entry.PlanSummary,
-		Document:    entry.Document,
+		Shape:       entry.Shape,
+		Document:    document,
+	}, nil
+}
+
+// recordID identifies a profile entry across cursor recoveries and restarts. The raw document is part of the hash since
+// many ops on the same namespace can share the same millisecond.
+func (entry *ProfilerEntry) recordID() string {
+	key := fmt.Sprintf("%s|%d|%s|%s|", entry.Host, entry.Timestamp.UnixMilli(), entry.OP, entry.Collection)
+	h1, h2 := murmur3.Hash(append([]byte(key), entry.Document...), 0)
+
+	return fmt.Sprintf("%016x%016x", uint64(h1), uint64(h2))
+}
+
+// comment is the comment attached to the command by the application (e.g. to tag the code path issuing the query).
+// Comments that aren't strings are kept as extended JSON.
+func (entry *ProfilerEntry) comment() string {
+	command, ok := entry.Document.Lookup("command").DocumentOK()
+	if !ok {
+		return ""
+	}
+
+	value, err := command.LookupErr("comment")
+	if err != nil && entry.OP == "getmore" { // Only set on the originating command when not passed to getMore
+		if originating, ok := entry.Document.Lookup("originatingCommand").DocumentOK(); ok {
+			value, err = originating.LookupErr("comment")
+		}
 	}
+	if err != nil {
+		return ""
+	}
+
+	if comment, ok := value.StringValueOK(); ok {
+		return comment
+	}
+
+	return value.String()
 }
 
+// clientHost drops the port of the client address, which changes with every connection and would prevent grouping
+// ops by client.
+func clientHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+// StoredQueryHash is the queryHash of the records of the entry, which groups them by query shape.
+//
 // Query Shape:
 // > A combination of query predicate, sort, projection, and collation.
 // > The query shape allows MongoDB to identify logically equivalent queries and analyze their performance.
 //
 // https://www.mongodb.com/docs/manual/reference/glossary/#std-term-query-shape
-func (entry *ProfilerEntry) queryHash() string {
+//
+// The server only reports a queryHash for some ops (and not on every version), so we fall back on our own shape.
+func (entry *ProfilerEntry) StoredQueryHash() string {
 	if entry.QueryHash != "" {
 		return entry.QueryHash // e.g. FFF0C0D3
 	}
 
-	// Need to be able to differentiate them
-	if entry.OP == "insert" || entry.OP == "delete" || entry.OP == "update" {
-		hash, _ := murmur3.Hash([]byte(fmt.Sprintf("%s-%s", entry.OP, entry.Collection)), 0)
-		return strings.ToUpper(strconv.FormatInt(hash, 16))[:8]
+	return entry.ShapeHash
+}
 
-		// Or something slightly resembling if murmur3 doesn't cut it
-		// return strings.ToUpper(strconv.FormatInt(int64(adler32.Checksum([]byte(fmt.Sprintf("%s-%s", entry.OP, entry.Collection)))), 16))
+// shape normalizes the command of the entry. A getMore has the shape of the command that opened the cursor.
+func (entry *ProfilerEntry) shape() bson.D {
+	if entry.OP == "getmore" {
+		if originating, ok := entry.Document.Lookup("originatingCommand").DocumentOK(); ok {
+			return shape.Of(entry.Collection, originating)
+		}
 	}
 
-	// Could we parse the query by passing it to the Mongo driver so that we can get the query + sort + projection?
-	// This way we could extract a query shape.
+	if command, ok := entry.Document.Lookup("command").DocumentOK(); ok {
+		return shape.Of(entry.Collection, command)
+	}
+
+	if query, ok := entry.Document.Lookup("query").DocumentOK(); ok { // Before MongoDB 3.6
+		return shape.Of(entry.Collection, query)
+	}
 
-	return ""
+	return bson.D{{Key: "ns", Value: entry.Collection}, {Key: "op", Value: entry.OP}}
 }
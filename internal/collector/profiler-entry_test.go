@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/shape"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestProfilerEntryMetrics(t *testing.T) {
+	t.Parallel()
+
+	data, err := bson.Marshal(bson.D{
+		{Key: "op", Value: "query"},
+		{Key: "ns", Value: "app.users"},
+		{Key: "command", Value: bson.D{{Key: "find", Value: "users"}, {Key: "filter", Value: bson.D{{Key: "status", Value: "active"}}}}},
+		{Key: "millis", Value: int32(120)},
+		{Key: "planningTimeMicros", Value: int64(830)},
+		{Key: "cpuNanos", Value: int64(115000000)},
+		{Key: "numYield", Value: int32(3)},
+		{Key: "replanned", Value: true},
+		{Key: "replanReason", Value: "cached plan was less efficient than expected"},
+		{Key: "errCode", Value: int32(50)},
+		{Key: "errName", Value: "MaxTimeMSExpired"},
+		{Key: "locks", Value: bson.D{
+			{Key: "Global", Value: bson.D{
+				{Key: "acquireCount", Value: bson.D{{Key: "r", Value: int64(4)}}},
+				{Key: "timeAcquiringMicros", Value: bson.D{{Key: "r", Value: int64(1500)}}},
+			}},
+			{Key: "Collection", Value: bson.D{
+				{Key: "acquireCount", Value: bson.D{{Key: "r", Value: int64(4)}}},
+				{Key: "timeAcquiringMicros", Value: bson.D{{Key: "r", Value: int64(500)}}},
+			}},
+		}},
+		{Key: "storage", Value: bson.D{{Key: "data", Value: bson.D{
+			{Key: "bytesRead", Value: int64(4096)},
+			{Key: "timeReadingMicros", Value: int64(9000)},
+		}}}},
+		{Key: "flowControl", Value: bson.D{{Key: "acquireCount", Value: int64(1)}}},
+		{Key: "ts", Value: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := NewProfilerEntry(Source{Host: "node1:27017"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := entry.ToSlowOpsRecord()
+
+	if record.PlanningTimeMicros != 830 || record.CPUNanos != 115000000 || record.NumYield != 3 {
+		t.Errorf("unexpected timings %+v", record)
+	}
+	if !record.Replanned || record.ErrName != "MaxTimeMSExpired" || record.ErrCode != 50 {
+		t.Errorf("unexpected plan or error fields %+v", record)
+	}
+	if record.LockWaitMicros != 2000 {
+		t.Errorf("expected 2000µs waiting for locks, got %v", record.LockWaitMicros)
+	}
+	if record.Storage == nil || record.Storage.Data.TimeReadingMicros != 9000 || record.Storage.Data.BytesRead != 4096 {
+		t.Errorf("unexpected storage stats %+v", record.Storage)
+	}
+	if record.FlowControl == nil || record.FlowControl.AcquireCount != 1 {
+		t.Errorf("unexpected flow control stats %+v", record.FlowControl)
+	}
+	if record.SchemaVersion == 0 {
+		t.Error("record should carry a schema version")
+	}
+}
+
+func TestProfilerEntryClient(t *testing.T) {
+	t.Parallel()
+
+	data, err := bson.Marshal(bson.D{
+		{Key: "op", Value: "getmore"},
+		{Key: "ns", Value: "app.users"},
+		{Key: "command", Value: bson.D{{Key: "getMore", Value: int64(42)}, {Key: "collection", Value: "users"}}},
+		{Key: "originatingCommand", Value: bson.D{{Key: "find", Value: "users"}, {Key: "comment", Value: "billing/export"}}},
+		{Key: "client", Value: "10.0.0.12:51234"},
+		{Key: "clientMetadata", Value: bson.D{
+			{Key: "application", Value: bson.D{{Key: "name", Value: "billing"}}},
+			{Key: "driver", Value: bson.D{{Key: "name", Value: "mongo-go-driver"}, {Key: "version", Value: "v1.9.1"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := NewProfilerEntry(Source{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Client != "10.0.0.12" {
+		t.Errorf("expected client without port, got %q", entry.Client)
+	}
+	if entry.AppName != "billing" {
+		t.Errorf("expected app name from client metadata, got %q", entry.AppName)
+	}
+	if entry.Comment != "billing/export" {
+		t.Errorf("expected comment of the originating command, got %q", entry.Comment)
+	}
+	if clientHost("[::1]:27017") != "::1" || clientHost("127.0.0.1") != "127.0.0.1" {
+		t.Error("unexpected client host")
+	}
+}
+
+func TestProfilerEntryShape(t *testing.T) {
+	t.Parallel()
+
+	find := bson.D{
+		{Key: "find", Value: "users"},
+		{Key: "filter", Value: bson.D{{Key: "email", Value: "john@example.com"}}},
+		{Key: "$db", Value: "app"},
+	}
+
+	data, err := bson.Marshal(bson.D{
+		{Key: "op", Value: "query"},
+		{Key: "ns", Value: "app.users"},
+		{Key: "command", Value: find},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := NewProfilerEntry(Source{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fallback := shape.Hash(bson.D{{Key: "ns", Value: "app.users"}, {Key: "op", Value: "query"}})
+	if entry.ShapeHash == fallback {
+		t.Fatalf("expected the shape of the command, got the fallback %v", entry.Shape)
+	}
+	if email := shapeValue(entry.Shape, "filter", "email"); email != "?string" {
+		t.Errorf("expected a placeholder for the email, got %v in %v", email, entry.Shape)
+	}
+
+	data, err = bson.Marshal(bson.D{
+		{Key: "op", Value: "getmore"},
+		{Key: "ns", Value: "app.users"},
+		{Key: "command", Value: bson.D{{Key: "getMore", Value: int64(42)}, {Key: "collection", Value: "users"}}},
+		{Key: "originatingCommand", Value: find},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getMore, err := NewProfilerEntry(Source{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if getMore.ShapeHash != entry.ShapeHash {
+		t.Errorf("expected the getMore to have the shape of its originating command, got %v", getMore.Shape)
+	}
+}
+
+// shapeValue returns the value at path in a shape, nil when missing.
+func shapeValue(d bson.D, path ...string) interface{} {
+	for _, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return e.Value
+		}
+		if child, ok := e.Value.(bson.D); ok {
+			return shapeValue(child, path[1:]...)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package collector
+
+// Metrics reported by the server in the profile document, stored as is so that the field paths match the MongoDB
+// documentation (https://www.mongodb.com/docs/manual/reference/database-profiler/).
+
+// LockStats are the counters of one resource in the locks field, keyed by lock mode (r, w, R, W).
+type LockStats struct {
+	AcquireCount        map[string]int64 `bson:"acquireCount,omitempty"`
+	AcquireWaitCount    map[string]int64 `bson:"acquireWaitCount,omitempty"`
+	TimeAcquiringMicros map[string]int64 `bson:"timeAcquiringMicros,omitempty"`
+	DeadlockCount       map[string]int64 `bson:"deadlockCount,omitempty"`
+}
+
+type StorageStats struct {
+	Data struct {
+		BytesRead         int64 `bson:"bytesRead,omitempty"`
+		TimeReadingMicros int64 `bson:"timeReadingMicros,omitempty"`
+		BytesWritten      int64 `bson:"bytesWritten,omitempty"`
+		TimeWritingMicros int64 `bson:"timeWritingMicros,omitempty"`
+	} `bson:"data,omitempty"`
+}
+
+type FlowControlStats struct {
+	AcquireCount        int64 `bson:"acquireCount,omitempty"`
+	AcquireWaitCount    int64 `bson:"acquireWaitCount,omitempty"`
+	TimeAcquiringMicros int64 `bson:"timeAcquiringMicros,omitempty"`
+	IsLagged            bool  `bson:"isLagged,omitempty"`
+}
+
+// lockWaitMicros is the time spent waiting for locks, all resources and modes included.
+func lockWaitMicros(locks map[string]LockStats) int64 {
+	var total int64
+	for _, stats := range locks {
+		for _, micros := range stats.TimeAcquiringMicros {
+			total += micros
+		}
+	}
+
+	return total
+}
+
+// ClientMetadata is the handshake document sent by the driver when opening the connection.
+type ClientMetadata struct {
+	Application struct {
+		Name string `bson:"name,omitempty"`
+	} `bson:"application,omitempty"`
+	Driver struct {
+		Name    string `bson:"name,omitempty"`
+		Version string `bson:"version,omitempty"`
+	} `bson:"driver,omitempty"`
+	OS struct {
+		Type         string `bson:"type,omitempty"`
+		Name         string `bson:"name,omitempty"`
+		Architecture string `bson:"architecture,omitempty"`
+		Version      string `bson:"version,omitempty"`
+	} `bson:"os,omitempty"`
+	Platform string `bson:"platform,omitempty"`
+}
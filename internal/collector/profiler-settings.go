@@ -0,0 +1,155 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProfilerSettings is the profiler configuration of a database on one node as we found it, so that we can put it back
+// when we stop. It is persisted so that the original state isn't lost if we crash before restoring it.
+type ProfilerSettings struct {
+	ID         string   `bson:"_id"` // <host>/<database>
+	Level      int64    `bson:"level"`
+	SlowMS     int64    `bson:"slowms"`
+	SampleRate float64  `bson:"sampleRate"`
+	Filter     bson.Raw `bson:"filter,omitempty"` // Only on MongoDB 4.4.2+
+	// system.profile is created on demand by the server, it might not exist yet
+	SystemProfileExists bool      `bson:"systemProfileExists"`
+	SystemProfileSize   int64     `bson:"systemProfileSize"`
+	CapturedAt          time.Time `bson:"capturedAt"`
+}
+
+type ProfilerSettingsStore struct {
+	collection *mongo.Collection
+}
+
+func InitProfilerSettingsCollection(ctx context.Context, db *mongo.Database) error {
+	if err := db.CreateCollection(ctx, constant.PROFILER_SETTINGS_COLLECTION); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewProfilerSettingsStore(db *mongo.Database) *ProfilerSettingsStore {
+	return &ProfilerSettingsStore{collection: db.Collection(constant.PROFILER_SETTINGS_COLLECTION)}
+}
+
+// Load returns the settings saved by a previous run that didn't get the chance to restore them, or nil.
+func (s *ProfilerSettingsStore) Load(ctx context.Context, id string) (*ProfilerSettings, error) {
+	settings := &ProfilerSettings{}
+	if err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(settings); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (s *ProfilerSettingsStore) Save(ctx context.Context, settings *ProfilerSettings) error {
+	opts := options.Replace()
+	opts.SetUpsert(true)
+
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": settings.ID}, settings, opts)
+	return err
+}
+
+func (s *ProfilerSettingsStore) Delete(ctx context.Context, id string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func readProfilerSettings(ctx context.Context, db *mongo.Database, id string) (*ProfilerSettings, error) {
+	res := db.RunCommand(ctx, bson.M{"profile": -1})
+	if res.Err() != nil {
+		return nil, fmt.Errorf("failed to read profiler settings: %w", res.Err())
+	}
+
+	var status struct {
+		Was        int64    `bson:"was"`
+		SlowMS     int64    `bson:"slowms"`
+		SampleRate float64  `bson:"sampleRate"`
+		Filter     bson.Raw `bson:"filter"`
+	}
+	if err := res.Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode profiler settings: %w", err)
+	}
+
+	settings := &ProfilerSettings{
+		ID:         id,
+		Level:      status.Was,
+		SlowMS:     status.SlowMS,
+		SampleRate: status.SampleRate,
+		Filter:     status.Filter,
+		CapturedAt: time.Now(),
+	}
+
+	var err error
+	settings.SystemProfileExists, settings.SystemProfileSize, err = systemProfileSize(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// restore puts the profiler back in the recorded state. system.profile is only recreated if we changed its size and
+// the node is writable.
+func (s *ProfilerSettings) restore(ctx context.Context, db *mongo.Database, writable bool) error {
+	// Profiler must be off to drop system.profile - no problem if it fails
+	db.RunCommand(ctx, bson.M{"profile": 0})
+
+	exists, size, err := systemProfileSize(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if writable && (exists != s.SystemProfileExists || size != s.SystemProfileSize) {
+		if err := db.Collection(constant.PROFILER_SYSTEM_PROFILE).Drop(ctx); err != nil {
+			return fmt.Errorf("failed to drop collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+		}
+
+		if s.SystemProfileExists {
+			createCollectionOptions := options.CreateCollectionOptions{}
+			createCollectionOptions.SetCapped(true)
+			createCollectionOptions.SetSizeInBytes(s.SystemProfileSize)
+
+			if err := db.CreateCollection(ctx, constant.PROFILER_SYSTEM_PROFILE, &createCollectionOptions); err != nil {
+				return fmt.Errorf("failed to create collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+			}
+		}
+	}
+
+	cmd := bson.D{
+		{Key: "profile", Value: s.Level},
+		{Key: "slowms", Value: s.SlowMS},
+	}
+	if s.SampleRate > 0 { // Not reported before MongoDB 3.6
+		cmd = append(cmd, bson.E{Key: "sampleRate", Value: s.SampleRate})
+	}
+	if len(s.Filter) > 0 {
+		cmd = append(cmd, bson.E{Key: "filter", Value: s.Filter})
+	}
+
+	if res := db.RunCommand(ctx, cmd); res.Err() != nil {
+		return fmt.Errorf("failed to restore profiler settings: %w", res.Err())
+	}
+
+	return nil
+}
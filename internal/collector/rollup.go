@@ -0,0 +1,289 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+	"github.com/guillotjulien/mongo-profiler/internal/sketch"
+	"github.com/guillotjulien/mongo-profiler/internal/utils/murmur3"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RollupRecord sums up the slow ops of a query shape over a time bucket, so that reports don't have to scan every
+// record. Counters are incremented as records arrive, so the documents of a bucket are complete once it is over.
+type RollupRecord struct {
+	ID            string         `bson:"_id"`    // Hash of the bucket and the fields below
+	Bucket        time.Time      `bson:"bucket"` // Start of the minute/hour
+	QueryHash     string         `bson:"queryHash"`
+	ShapeHash     string         `bson:"shapeHash,omitempty"`
+	Collection    string         `bson:"collection"`
+	User          string         `bson:"user"`
+	Host          string         `bson:"host"`
+	Count         int64          `bson:"count"`
+	SumDurationMS int64          `bson:"sumDurationMS"`
+	MinDurationMS int64          `bson:"minDurationMS"`
+	MaxDurationMS int64          `bson:"maxDurationMS"`
+	DocExamined   int64          `bson:"docsExamined"`
+	KeysExamined  int64          `bson:"keysExamined"`
+	NReturned     int64          `bson:"nreturned"`
+	Durations     *sketch.Sketch `bson:"durations"` // Percentiles of durationMS, bins are merged with $inc
+}
+
+type rollupLevel struct {
+	collection *mongo.Collection
+	truncate   time.Duration
+	pending    map[string]*RollupRecord // Deltas since the last flush
+}
+
+// Rollups maintains the per-minute and per-hour rollups of slow ops.
+type Rollups struct {
+	flushInterval time.Duration
+	ctx           context.Context
+
+	lock   sync.Mutex
+	levels []*rollupLevel
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	failed *metrics.Counter
+}
+
+func InitRollupCollections(ctx context.Context, db *mongo.Database) error {
+	collections := map[string]int32{
+		constant.PROFILER_ROLLUP_MINUTE_COLLECTION: constant.PROFILER_ROLLUP_MINUTE_EXPIRE_SECONDS,
+		constant.PROFILER_ROLLUP_HOUR_COLLECTION:   constant.PROFILER_ROLLUP_HOUR_EXPIRE_SECONDS,
+	}
+
+	for name, expireSeconds := range collections {
+		if err := db.CreateCollection(ctx, name); err != nil {
+			if e, ok := err.(mongo.ServerError); ok {
+				if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+					return err
+				}
+			} else {
+				return err
+			}
+		}
+
+		options := options.Index()
+		options.SetExpireAfterSeconds(expireSeconds)
+
+		_, err := db.Collection(name).Indexes().CreateMany(
+			ctx,
+			[]mongo.IndexModel{
+				{
+					Keys:    bson.M{"bucket": 1},
+					Options: options,
+				},
+				{
+					Keys: bson.D{
+						{Key: "queryHash", Value: 1},
+						{Key: "bucket", Value: 1},
+					},
+				},
+			},
+		)
+		if err != nil {
+			if e, ok := err.(mongo.ServerError); ok {
+				if !e.HasErrorCode(constant.MONGO_INDEX_EXISTS_ERROR) {
+					return err
+				}
+			} else {
+				return err
+			}
+
+			// The TTL index may have been created with another expiry by a previous version
+			if err := db.RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: name},
+				{Key: "index", Value: bson.D{{Key: "keyPattern", Value: bson.M{"bucket": 1}}, {Key: "expireAfterSeconds", Value: expireSeconds}}},
+			}).Err(); err != nil {
+				return fmt.Errorf("failed to update expiry of %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func NewRollups(ctx context.Context, db *mongo.Database, flushInterval time.Duration) *Rollups {
+	r := &Rollups{}
+	r.flushInterval = flushInterval
+	r.ctx = ctx
+	r.levels = []*rollupLevel{
+		{collection: db.Collection(constant.PROFILER_ROLLUP_MINUTE_COLLECTION), truncate: time.Minute, pending: map[string]*RollupRecord{}},
+		{collection: db.Collection(constant.PROFILER_ROLLUP_HOUR_COLLECTION), truncate: time.Hour, pending: map[string]*RollupRecord{}},
+	}
+	r.done = make(chan struct{})
+	r.failed = metrics.NewCounter("rollups.failed")
+
+	r.wg.Add(1)
+	go r.flushPeriodically()
+
+	return r
+}
+
+// Add accounts the record in the minute and hour buckets it belongs to.
+func (r *Rollups) Add(record *SlowOpsRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, level := range r.levels {
+		bucket := record.Timestamp.UTC().Truncate(level.truncate)
+		id := rollupID(bucket, record)
+
+		rollup, ok := level.pending[id]
+		if !ok {
+			rollup = &RollupRecord{
+				ID:            id,
+				Bucket:        bucket,
+				QueryHash:     record.QueryHash,
+				ShapeHash:     record.ShapeHash,
+				Collection:    record.Collection,
+				User:          record.User,
+				Host:          record.Host,
+				MinDurationMS: math.MaxInt64,
+				Durations:     sketch.New(),
+			}
+			level.pending[id] = rollup
+		}
+
+		duration := int64(record.DurationMS)
+
+		rollup.Count++
+		rollup.SumDurationMS += duration
+		if duration < rollup.MinDurationMS {
+			rollup.MinDurationMS = duration
+		}
+		if duration > rollup.MaxDurationMS {
+			rollup.MaxDurationMS = duration
+		}
+		rollup.DocExamined += int64(record.DocExamined)
+		rollup.KeysExamined += int64(record.KeysExamined)
+		rollup.NReturned += int64(record.NReturned)
+		rollup.Durations.Add(float64(duration))
+	}
+}
+
+// Flush merges the pending deltas into the stored rollups.
+func (r *Rollups) Flush(ctx context.Context) {
+	r.lock.Lock()
+	pending := make([]map[string]*RollupRecord, len(r.levels))
+	for i, level := range r.levels {
+		pending[i] = level.pending
+		level.pending = map[string]*RollupRecord{}
+	}
+	r.lock.Unlock()
+
+	for i, level := range r.levels {
+		if len(pending[i]) == 0 {
+			continue
+		}
+
+		models := make([]mongo.WriteModel, 0, len(pending[i]))
+		for _, rollup := range pending[i] {
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": rollup.ID}).
+				SetUpdate(rollup.update()).
+				SetUpsert(true))
+		}
+
+		opts := options.BulkWrite()
+		opts.SetOrdered(false)
+
+		if _, err := level.collection.BulkWrite(ctx, models, opts); err != nil {
+			r.failed.Add(int64(len(models)))
+			logger.Warn("failed to update %v rollups in %s: %v", len(models), level.collection.Name(), err)
+		}
+	}
+}
+
+// Close stops the periodic flush and writes what's still pending.
+func (r *Rollups) Close(ctx context.Context) {
+	close(r.done)
+	r.wg.Wait()
+
+	r.Flush(ctx)
+}
+
+func (r *Rollups) flushPeriodically() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.Flush(r.ctx)
+		}
+	}
+}
+
+func (rollup *RollupRecord) update() bson.M {
+	inc := bson.M{
+		"count":         rollup.Count,
+		"sumDurationMS": rollup.SumDurationMS,
+		"docsExamined":  rollup.DocExamined,
+		"keysExamined":  rollup.KeysExamined,
+		"nreturned":     rollup.NReturned,
+	}
+	for bin, count := range rollup.Durations.Bins() {
+		inc["durations."+bin] = count
+	}
+
+	return bson.M{
+		"$setOnInsert": bson.M{
+			"bucket":     rollup.Bucket,
+			"queryHash":  rollup.QueryHash,
+			"shapeHash":  rollup.ShapeHash,
+			"collection": rollup.Collection,
+			"user":       rollup.User,
+			"host":       rollup.Host,
+		},
+		"$min": bson.M{"minDurationMS": rollup.MinDurationMS},
+		"$max": bson.M{"maxDurationMS": rollup.MaxDurationMS},
+		"$inc": inc,
+	}
+}
+
+func rollupID(bucket time.Time, record *SlowOpsRecord) string {
+	key := fmt.Sprintf("%d|%s|%s|%s|%s", bucket.Unix(), record.QueryHash, record.Collection, record.User, record.Host)
+	h1, h2 := murmur3.Hash([]byte(key), 0)
+
+	return fmt.Sprintf("%016x%016x", uint64(h1), uint64(h2))
+}
+
+// MergeDurations merges the duration sketches of the rollups matching filter, so that percentiles can be computed over
+// any time range, e.g. MergeDurations(ctx, hourly, bson.M{"queryHash": hash, "bucket": bson.M{"$gte": since}}).
+func MergeDurations(ctx context.Context, collection *mongo.Collection, filter interface{}) (*sketch.Sketch, error) {
+	opts := options.Find()
+	opts.SetProjection(bson.M{"durations": 1})
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	durations := sketch.New()
+	for cursor.Next(ctx) {
+		rollup := &RollupRecord{}
+		if err := cursor.Decode(rollup); err != nil {
+			return nil, err
+		}
+		durations.Merge(rollup.Durations)
+	}
+
+	return durations, cursor.Err()
+}
@@ -0,0 +1,36 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollupsAdd(t *testing.T) {
+	t.Parallel()
+
+	r := &Rollups{levels: []*rollupLevel{
+		{truncate: time.Minute, pending: map[string]*RollupRecord{}},
+		{truncate: time.Hour, pending: map[string]*RollupRecord{}},
+	}}
+	ts := time.Date(2022, 6, 1, 12, 30, 10, 0, time.UTC)
+
+	r.Add(&SlowOpsRecord{Timestamp: ts, QueryHash: "FFF0C0D3", Collection: "app.users", DurationMS: 120, DocExamined: 10})
+	r.Add(&SlowOpsRecord{Timestamp: ts.Add(5 * time.Second), QueryHash: "FFF0C0D3", Collection: "app.users", DurationMS: 300, DocExamined: 20})
+	r.Add(&SlowOpsRecord{Timestamp: ts.Add(time.Minute), QueryHash: "FFF0C0D3", Collection: "app.users", DurationMS: 200})
+
+	if len(r.levels[0].pending) != 2 || len(r.levels[1].pending) != 1 {
+		t.Fatalf("expected 2 minute and 1 hour buckets, got %v and %v", len(r.levels[0].pending), len(r.levels[1].pending))
+	}
+
+	for _, hour := range r.levels[1].pending {
+		if !hour.Bucket.Equal(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected bucket %v", hour.Bucket)
+		}
+		if hour.Count != 3 || hour.SumDurationMS != 620 || hour.MinDurationMS != 120 || hour.MaxDurationMS != 300 || hour.DocExamined != 30 {
+			t.Errorf("unexpected hour rollup %+v", hour)
+		}
+		if hour.Durations.Count() != 3 {
+			t.Errorf("expected 3 durations in the sketch, got %v", hour.Durations.Count())
+		}
+	}
+}
@@ -2,6 +2,7 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"io"
 
 	"github.com/guillotjulien/mongo-profiler/internal/constant"
@@ -14,9 +15,11 @@ import (
 
 type SlowOpsExampleRecord struct {
 	QueryHash   string   `bson:"queryHash"` // queryHash + collection should be unique
+	ShapeHash   string   `bson:"shapeHash"`
 	Collection  string   `bson:"collection"`
 	PlanHash    string   `bson:"planHash"`
 	PlanSummary string   `bson:"planSummary"` // Summary of used plan (can group queries by plan used)
+	Shape       bson.D   `bson:"shape"`       // Parameterized query, e.g. {find: "users", filter: {status: "?string"}}
 	Document    bson.Raw `bson:"document"`
 }
 
@@ -73,10 +76,12 @@ func (r *SlowOpsExampleRecord) TryInsert(writer io.Writer) {
 	data, err := bson.Marshal(r)
 	if err != nil {
 		logger.Warn("failed to insert slow ops example record %+v: %v", r, err) // Simply add as an error, but we don't really care. We could react if we see that the amount is too high
+		return
 	}
 
 	if _, err = writer.Write(data); err != nil {
-		if e, ok := err.(mongo.ServerError); ok {
+		var e mongo.ServerError
+		if errors.As(err, &e) {
 			// Simply means we already have this example stored
 			if e.HasErrorCode(constant.MONGO_DUPLICATE_DOCUMENT_ERROR) {
 				return
@@ -2,6 +2,7 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"io"
 	"time"
 
@@ -14,24 +15,51 @@ import (
 )
 
 type SlowOpsRecord struct {
-	Host           string    // This is provided by the conf
-	Timestamp      time.Time `bson:"timestamp,omitempty"`
-	OP             string    `bson:"op,omitempty"`
-	Collection     string    `bson:"collection,omitempty"`
-	User           string    `bson:"user,omitempty"`
-	ResponseLength int       `bson:"responseLength,omitempty"`
-	DurationMS     int       `bson:"durationMS,omitempty"`
-	CursorID       int64     `bson:"cursorID,omitempty"` // Used to group by cursor
-	KeysExamined   int       `bson:"keysExamined,omitempty"`
-	DocExamined    int       `bson:"docsExamined,omitempty"`
-	HasSortStage   bool      `bson:"hasSortStage,omitempty"`
-	NReturned      int       `bson:"nreturned,omitempty"`
-	NDeleted       int       `bson:"ndeleted,omitempty"`
-	NInserted      int       `bson:"ninserted,omitempty"`
-	NModified      int       `bson:"nmodified,omitempty"`
-	QueryHash      string    `bson:"queryHash,omitempty"`   // Identify queries with the same shape (so that we can group and find examples)
-	PlanHash       string    `bson:"planHash,omitempty"`    // Identify queries with the same plan (so that we can find all queries using specific index or all non-indexed queries)
-	PlanSummary    string    `bson:"planSummary,omitempty"` // Make plan hash more readable by storing the summary
+	ID             string          `bson:"_id,omitempty"` // Deterministic so that the same profile entry is only stored once
+	SchemaVersion  int             `bson:"schemaVersion"` // Records without it were stored before the metrics below were captured
+	Host           string          // Node that served the operation
+	Shard          string          `bson:"shard,omitempty"` // Only set for sharded clusters
+	Database       string          `bson:"database,omitempty"`
+	Timestamp      time.Time       `bson:"timestamp,omitempty"`
+	OP             string          `bson:"op,omitempty"`
+	Collection     string          `bson:"collection,omitempty"`
+	User           string          `bson:"user,omitempty"`
+	AppName        string          `bson:"appName,omitempty"` // Many services can share the same user, the app name tells them apart
+	Client         string          `bson:"client,omitempty"`  // Address of the client, without the port
+	ClientMetadata *ClientMetadata `bson:"clientMetadata,omitempty"`
+	Comment        string          `bson:"comment,omitempty"` // Set by the application to tag the code path issuing the query
+	ResponseLength int             `bson:"responseLength,omitempty"`
+	DurationMS     int             `bson:"durationMS,omitempty"`
+	CursorID       int64           `bson:"cursorID,omitempty"` // Used to group by cursor
+	KeysExamined   int             `bson:"keysExamined,omitempty"`
+	DocExamined    int             `bson:"docsExamined,omitempty"`
+	HasSortStage   bool            `bson:"hasSortStage,omitempty"`
+	NReturned      int             `bson:"nreturned,omitempty"`
+	NDeleted       int             `bson:"ndeleted,omitempty"`
+	NInserted      int             `bson:"ninserted,omitempty"`
+	NModified      int             `bson:"nmodified,omitempty"`
+	QueryHash      string          `bson:"queryHash,omitempty"`   // Identify queries with the same shape (so that we can group and find examples)
+	ShapeHash      string          `bson:"shapeHash,omitempty"`   // Same as queryHash but always computed by us, so it doesn't depend on the server version
+	PlanHash       string          `bson:"planHash,omitempty"`    // Identify queries with the same plan (so that we can find all queries using specific index or all non-indexed queries)
+	PlanSummary    string          `bson:"planSummary,omitempty"` // Make plan hash more readable by storing the summary
+
+	// Where the time went: planning, locks, disk or flow control
+	PlanningTimeMicros int64                `bson:"planningTimeMicros,omitempty"`
+	CPUNanos           int64                `bson:"cpuNanos,omitempty"` // Linux only
+	NumYield           int                  `bson:"numYield,omitempty"`
+	WriteConflicts     int                  `bson:"writeConflicts,omitempty"`
+	KeysInserted       int                  `bson:"keysInserted,omitempty"`
+	KeysDeleted        int                  `bson:"keysDeleted,omitempty"`
+	Replanned          bool                 `bson:"replanned,omitempty"`
+	ReplanReason       string               `bson:"replanReason,omitempty"`
+	ErrCode            int                  `bson:"errCode,omitempty"`
+	ErrName            string               `bson:"errName,omitempty"`
+	QueryFramework     string               `bson:"queryFramework,omitempty"` // classic or sbe
+	PlanCacheShapeHash string               `bson:"planCacheShapeHash,omitempty"`
+	Locks              map[string]LockStats `bson:"locks,omitempty"`
+	LockWaitMicros     int64                `bson:"lockWaitMicros,omitempty"` // Sum of locks.*.timeAcquiringMicros, easier to sort on
+	Storage            *StorageStats        `bson:"storage,omitempty"`
+	FlowControl        *FlowControlStats    `bson:"flowControl,omitempty"`
 }
 
 func InitSlowOpsRecordCollection(ctx context.Context, db *mongo.Database) error {
@@ -64,6 +92,24 @@ func InitSlowOpsRecordCollection(ctx context.Context, db *mongo.Database) error
 			{
 				Keys: bson.M{"queryHash": 1},
 			},
+			{
+				Keys: bson.M{"shapeHash": 1},
+			},
+			{
+				Keys: bson.M{"shard": 1},
+			},
+			{
+				Keys: bson.M{"database": 1},
+			},
+			{
+				Keys: bson.M{"appName": 1},
+			},
+			{
+				Keys: bson.M{"client": 1},
+			},
+			{
+				Keys: bson.M{"comment": 1},
+			},
 		},
 	)
 	if err != nil {
@@ -83,9 +129,17 @@ func (r *SlowOpsRecord) TryInsert(writer io.Writer) {
 	data, err := bson.Marshal(r)
 	if err != nil {
 		logger.Warn("failed to insert slow ops record %+v: %v", r, err) // Simply add as an error, but we don't really care. We could react if we see that the amount is too high
+		return
 	}
 
 	if _, err = writer.Write(data); err != nil {
+		var e mongo.ServerError
+		if errors.As(err, &e) {
+			// Entry was already stored (e.g. read again after a cursor recovery)
+			if e.HasErrorCode(constant.MONGO_DUPLICATE_DOCUMENT_ERROR) {
+				return
+			}
+		}
 		logger.Warn("failed to insert slow ops record %+v: %v", r, err) // Simply add as an error, but we don't really care. We could react if we see that the amount is too high
 	}
 }
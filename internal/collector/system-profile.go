@@ -0,0 +1,117 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var systemProfileMaxSizeReached = metrics.NewCounter("collector.systemprofile.max_size_reached")
+
+// throughput measures how fast entries are written to system.profile, so that we can size it to hold
+// PROFILER_SYSTEM_PROFILE_RETENTION worth of entries.
+type throughput struct {
+	since   time.Time
+	entries int64
+	bytes   int64
+}
+
+func (tp *throughput) observe(size int) {
+	if tp.since.IsZero() {
+		tp.since = time.Now()
+	}
+
+	tp.entries++
+	tp.bytes += int64(size)
+}
+
+// estimate returns the size needed to hold PROFILER_SYSTEM_PROFILE_RETENTION worth of entries, or 0 if we didn't
+// observe enough entries yet.
+func (tp *throughput) estimate() int64 {
+	elapsed := time.Since(tp.since)
+	if tp.entries < 2 || elapsed < time.Second {
+		return 0
+	}
+
+	opsPerSecond := float64(tp.entries) / elapsed.Seconds()
+	avgSize := float64(tp.bytes) / float64(tp.entries)
+
+	return int64(opsPerSecond * avgSize * constant.PROFILER_SYSTEM_PROFILE_RETENTION.Seconds())
+}
+
+// observeSystemProfile seeds the throughput from the entries already in system.profile (e.g. profiler was enabled by
+// a DBA or by a previous run).
+func observeSystemProfile(ctx context.Context, db *mongo.Database) (throughput, error) {
+	res := db.RunCommand(ctx, bson.M{"collStats": constant.PROFILER_SYSTEM_PROFILE})
+	if res.Err() != nil {
+		if e, ok := res.Err().(mongo.ServerError); ok && e.HasErrorCode(constant.MONGO_NAMESPACE_NOT_FOUND_ERROR) {
+			return throughput{}, nil
+		}
+		return throughput{}, fmt.Errorf("failed to read %s stats: %w", constant.PROFILER_SYSTEM_PROFILE, res.Err())
+	}
+
+	var stats struct {
+		Count int64 `bson:"count"`
+		Size  int64 `bson:"size"`
+	}
+	if err := res.Decode(&stats); err != nil {
+		return throughput{}, fmt.Errorf("failed to decode %s stats: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+	}
+
+	if stats.Count < 2 {
+		return throughput{}, nil
+	}
+
+	var first, last struct {
+		Timestamp time.Time `bson:"ts"`
+	}
+
+	collection := db.Collection(constant.PROFILER_SYSTEM_PROFILE)
+	projection := bson.M{"ts": 1}
+
+	if err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"$natural": 1}).SetProjection(projection)).Decode(&first); err != nil {
+		return throughput{}, fmt.Errorf("failed to read oldest %s entry: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+	}
+	if err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"$natural": -1}).SetProjection(projection)).Decode(&last); err != nil {
+		return throughput{}, fmt.Errorf("failed to read newest %s entry: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+	}
+
+	// Rate is measured between the oldest and newest entries, not until now
+	return throughput{
+		since:   time.Now().Add(-last.Timestamp.Sub(first.Timestamp)),
+		entries: stats.Count,
+		bytes:   stats.Size,
+	}, nil
+}
+
+// systemProfileSize returns the capped size of system.profile, if the collection exists. A collection that isn't
+// capped has a size of 0.
+func systemProfileSize(ctx context.Context, db *mongo.Database) (bool, int64, error) {
+	cursor, err := db.ListCollections(ctx, bson.M{"name": constant.PROFILER_SYSTEM_PROFILE})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to list collections: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		return false, 0, cursor.Err()
+	}
+
+	var spec struct {
+		Options struct {
+			Size int64 `bson:"size"`
+		} `bson:"options"`
+	}
+	if err := cursor.Decode(&spec); err != nil {
+		return false, 0, fmt.Errorf("failed to decode %s specification: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+	}
+
+	return true, spec.Options.Size, nil
+}
@@ -0,0 +1,30 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+)
+
+func TestSystemProfileTargetSize(t *testing.T) {
+	t.Parallel()
+
+	idle := &tailer{}
+	if size := idle.systemProfileTargetSize(0); size != constant.PROFILER_SYSTEM_PROFILE_MIN_SIZE {
+		t.Errorf("expected minimum size without throughput, got %v", size)
+	}
+	if size := idle.systemProfileTargetSize(4 * constant.PROFILER_SYSTEM_PROFILE_MIN_SIZE); size != 4*constant.PROFILER_SYSTEM_PROFILE_MIN_SIZE {
+		t.Errorf("expected requested size to be kept, got %v", size)
+	}
+	if size := idle.systemProfileTargetSize(2 * constant.PROFILER_SYSTEM_PROFILE_MAX_SIZE); size != constant.PROFILER_SYSTEM_PROFILE_MAX_SIZE {
+		t.Errorf("expected size to be capped, got %v", size)
+	}
+
+	// 100 ops/s of 1KB
+	busy := &tailer{throughput: throughput{since: time.Now().Add(-10 * time.Second), entries: 1000, bytes: 1000 * 1024}}
+	expected := int64(100 * 1024 * constant.PROFILER_SYSTEM_PROFILE_RETENTION.Seconds())
+	if size := busy.systemProfileTargetSize(0); size < expected*95/100 || size > expected {
+		t.Errorf("expected size estimated from throughput (~%v), got %v", expected, size)
+	}
+}
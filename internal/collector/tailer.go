@@ -0,0 +1,548 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tailer follows system.profile on a single node. It either sticks to one member (direct connection) or follows the
+// primary of the replica set the client is connected to.
+type tailer struct {
+	client          *mgo.Client
+	database        string
+	slowThresholdMS uint64
+	profilerLevel   uint
+	followPrimary   bool
+	primaryChanged  <-chan string // Notifications of this tailer only, nil when sticking to one member
+
+	source                   Source        // Node currently being profiled
+	needsProfilerSetup       bool          // Set when the profiler isn't enabled on the node yet (e.g. new primary or member unreachable at startup)
+	stopChangeStream         chan struct{} // Closed when the tailer must stop
+	exited                   chan struct{} // Closed when run returns
+	currentSystemProfileSize int64
+	throughput               throughput
+
+	checkpoints       *CheckpointStore // nil when positions are only kept in memory
+	checkpointLock    sync.Mutex
+	checkpoint        *Checkpoint
+	checkpointDirty   bool
+	checkpointSavedAt time.Time
+
+	settingsStore *ProfilerSettingsStore // nil when original settings are only kept in memory
+	originalsLock sync.Mutex
+	originals     map[string]*ProfilerSettings // Settings found on each node before we changed them, by host
+}
+
+func newTailer(client *mgo.Client, source Source, database string, followPrimary bool, opts CollectorOptions) *tailer {
+	t := &tailer{}
+	t.client = client
+	t.database = database
+	t.source = source
+	t.followPrimary = followPrimary
+	t.slowThresholdMS = opts.SlowThresholdMS
+	t.profilerLevel = opts.ProfilerLevel
+	t.checkpoints = opts.Checkpoints
+	t.stopChangeStream = make(chan struct{})
+	t.exited = make(chan struct{})
+	t.settingsStore = opts.ProfilerSettings
+	t.originals = map[string]*ProfilerSettings{}
+
+	host := source.Host
+	if followPrimary { // The primary moves around, but the position belongs to the whole replica set
+		host = strings.Join(client.Connstr.Hosts, ",")
+		t.primaryChanged = client.PrimaryChanged()
+	}
+	t.checkpoint = &Checkpoint{ID: fmt.Sprintf("%s/%s", host, database)}
+
+	return t
+}
+
+func (t *tailer) run(ctx context.Context, p *pool) error {
+	defer close(t.exited)
+
+	if t.checkpoints != nil {
+		cp, err := t.checkpoints.Load(ctx, t.checkpoint.ID)
+		if err != nil {
+			return fmt.Errorf("failed to load checkpoint %s: %w", t.checkpoint.ID, err)
+		}
+
+		logger.Info("resuming %s from %s", cp.ID, cp.Timestamp)
+		t.checkpoint = cp
+	}
+
+	if err := t.setupProfiler(ctx); err != nil {
+		// Node might be unreachable or stepping down, keep trying from the loop
+		logger.Error("failed to enable profiler for database %s on %s: %v", t.database, t.source.Host, err)
+		t.needsProfilerSetup = true
+	}
+
+	db := t.db()
+
+	// start change stream
+	collection := db.Collection(constant.PROFILER_SYSTEM_PROFILE)
+
+	// No way to open a change stream against a system collection so use a tailable cursor instead (https://www.mongodb.com/community/forums/t/why-change-streams-cannot-be-used-with-local-database/3063)
+	var cursor *mongo.Cursor
+	cursorOptions := options.FindOptions{}
+	cursorOptions.SetCursorType(options.Tailable)
+	cursorOptions.SetSort(bson.M{"$natural": 1})
+
+	logger.Info("starting change stream against %s.%s on %s", t.database, constant.PROFILER_SYSTEM_PROFILE, t.source.Host)
+
+	failures := 0 // Consecutive cursor errors, reset once the cursor reads again
+	for !t.stopped() {
+		if ctx.Err() != nil {
+			logger.Warn("change stream cursor error %v", ctx.Err())
+		}
+
+		if err := t.saveCheckpoint(ctx, false); err != nil {
+			logger.Warn("failed to save checkpoint %s: %v", t.checkpoint.ID, err)
+		}
+
+		if t.primaryMoved() && cursor != nil {
+			cursor.Close(ctx)
+			cursor = nil
+		}
+
+		if cursor != nil && cursor.Err() != nil {
+			failures++
+			if err := t.recoverCursor(ctx, cursor.Err()); err != nil {
+				logger.Error("%v", err)
+			}
+		}
+
+		if cursor == nil || cursor.ID() == 0 || ctx.Err() != nil || cursor.Err() != nil { // Cursor was closed - create a new cursor (actually fine since this is a very small capped collection)
+			if cursor != nil {
+				cursor.Close(ctx)
+				cursor = nil
+			}
+
+			wait := retryAfter(failures)
+			logger.Info("change stream cursor closed for %s on %s. Will retry after %s", constant.PROFILER_SYSTEM_PROFILE, t.source.Host, wait.String())
+			select { // make sure we can cancel the wait and close fast
+			case <-ctx.Done():
+			case <-t.stopChangeStream:
+			case <-time.After(wait):
+			}
+
+			if t.stopped() { // Make sure we quit when we were sleeping and we suddenly stop the change stream
+				break
+			}
+
+			if t.needsProfilerSetup {
+				if err := t.setupProfiler(ctx); err != nil {
+					logger.Error("failed to enable profiler on %s: %v", t.source.Host, err)
+					failures++
+					continue
+				}
+				t.needsProfilerSetup = false
+			}
+
+			t.checkpointLock.Lock()
+			cursorQuery := bson.M{
+				"ns": bson.M{
+					"$regex": fmt.Sprintf("^%s\\.", regexp.QuoteMeta(t.database)),                // only the database we profile
+					"$ne":    fmt.Sprintf("%s.%s", t.database, constant.PROFILER_SYSTEM_PROFILE), // all collections except system.profile
+				},
+				"ts": bson.M{
+					"$gte": t.checkpoint.Timestamp, // entries sharing the last timestamp are filtered using the checkpoint
+				},
+			}
+			t.checkpointLock.Unlock()
+
+			var err error
+			cursor, err = collection.Find(ctx, cursorQuery, &cursorOptions)
+			if err != nil {
+				logger.Error("failed to obtain cursor for %s on %s: %v", constant.PROFILER_SYSTEM_PROFILE, t.source.Host, err)
+				failures++
+			}
+		}
+
+		if cursor == nil {
+			continue
+		}
+
+		hasNext := cursor.TryNext(ctx)
+		if cursor.Err() == nil {
+			failures = 0
+		}
+		if !hasNext {
+			continue
+		}
+
+		// Only ts is read here, the full decoding happens in the workers
+		ts, hash, err := entryPosition(cursor.Current)
+		if err != nil {
+			logger.Warn("failed to read position of profile entry: %v", err)
+		} else if !t.advance(ts, hash) {
+			continue // Already processed before the cursor was recreated
+		}
+
+		t.throughput.observe(len(cursor.Current))
+		p.submit(ctx, t.source, cursor.Current)
+	}
+
+	if cursor != nil {
+		cursor.Close(ctx)
+	}
+
+	return nil
+}
+
+// recoverCursor fixes what made the cursor fail when possible. The cursor is recreated either way, the returned error
+// is only there to be logged.
+func (t *tailer) recoverCursor(ctx context.Context, err error) error {
+	if e, ok := err.(mongo.ServerError); ok && e.HasErrorCode(constant.MONGO_CAPPED_POSITION_LOST_ERROR) {
+		// Entries were overwritten before we read them, system.profile is too small for the load
+		logger.Warn("change stream cursor error %v", err)
+		logger.Info("attempting to resize %s on %s", constant.PROFILER_SYSTEM_PROFILE, t.source.Host)
+		if err := t.increaseSystemProfileSize(ctx); err != nil {
+			t.needsProfilerSetup = true // Profiler might be off if we failed halfway
+			return fmt.Errorf("failed to resize %s on %s: %w", constant.PROFILER_SYSTEM_PROFILE, t.source.Host, err)
+		}
+		return nil
+	}
+
+	if mongo.IsNetworkError(err) {
+		// Most likely a stepdown, the topology monitor will tell us where the new primary is
+		logger.Warn("lost connection with %s: %v", t.source.Host, err)
+		return nil
+	}
+
+	// e.g. system.profile dropped, profiler disabled by someone else, missing privileges
+	t.needsProfilerSetup = true
+	return fmt.Errorf("change stream cursor error for database %s on %s: %w", t.database, t.source.Host, err)
+}
+
+// primaryMoved points the tailer to the new primary after an election. system.profile is node-local: the new primary
+// has its own (possibly disabled) profiler.
+func (t *tailer) primaryMoved() bool {
+	select {
+	case primary := <-t.primaryChanged: // Never ready when nil
+		if primary == t.source.Host {
+			return false
+		}
+
+		logger.Warn("primary changed from %s to %s. Moving collector for database %s to the new primary", t.source.Host, primary, t.database)
+
+		t.source.Host = primary
+		t.needsProfilerSetup = true
+
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *tailer) db() *mongo.Database {
+	return t.client.C.Database(t.database)
+}
+
+func (t *tailer) stopped() bool {
+	select {
+	case <-t.stopChangeStream:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *tailer) stop(ctx context.Context) error {
+	// 1. stop change stream, and wait for run to exit so that it can't enable the profiler again or move the checkpoint
+	if !t.stopped() {
+		close(t.stopChangeStream)
+	}
+
+	select {
+	case <-t.exited:
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for the collector of database %s to stop, profiler left as is: %w", t.database, ctx.Err())
+	}
+
+	if err := t.saveCheckpoint(ctx, true); err != nil {
+		logger.Warn("failed to save checkpoint %s: %v", t.checkpoint.ID, err)
+	}
+
+	// 2. put the profiler back the way we found it
+	t.originalsLock.Lock()
+	defer t.originalsLock.Unlock()
+
+	var restoreErr error
+	for host, original := range t.originals {
+		if err := t.restoreProfilerSettings(ctx, host, original); err != nil {
+			if restoreErr == nil {
+				restoreErr = fmt.Errorf("failed to restore profiler for Mongo host %v (database: %s): %w", host, t.database, err)
+			}
+			continue
+		}
+
+		logger.Info("restored profiler level %v (slowms: %v) on %s", original.Level, original.SlowMS, host)
+
+		if t.settingsStore != nil {
+			if err := t.settingsStore.Delete(ctx, original.ID); err != nil {
+				logger.Warn("failed to delete saved profiler settings %s: %v", original.ID, err)
+			}
+		}
+		delete(t.originals, host)
+	}
+
+	return restoreErr
+}
+
+func (t *tailer) restoreProfilerSettings(ctx context.Context, host string, original *ProfilerSettings) error {
+	client := t.client
+	if t.followPrimary && host != t.client.Primary() { // Node stepped down since we changed its settings
+		memberClient, err := t.client.NewMemberClient(host)
+		if err != nil {
+			return err
+		}
+		if err := memberClient.Connect(ctx); err != nil {
+			return err
+		}
+		defer memberClient.Disconnect(ctx)
+
+		client = memberClient
+	}
+
+	hello, err := client.Hello(ctx)
+	if err != nil {
+		return err
+	}
+
+	return original.restore(ctx, client.C.Database(t.database), hello.Writable())
+}
+
+// captureOriginalSettings records the profiler settings of the current node before we change them. Settings left by
+// a previous run that crashed take precedence since the node still has our settings.
+func (t *tailer) captureOriginalSettings(ctx context.Context) error {
+	host := t.source.Host
+
+	t.originalsLock.Lock()
+	_, captured := t.originals[host]
+	t.originalsLock.Unlock()
+
+	if captured {
+		return nil
+	}
+
+	id := fmt.Sprintf("%s/%s", host, t.database)
+
+	var original *ProfilerSettings
+	if t.settingsStore != nil {
+		var err error
+		if original, err = t.settingsStore.Load(ctx, id); err != nil {
+			return fmt.Errorf("failed to load saved profiler settings %s: %w", id, err)
+		}
+		if original != nil {
+			logger.Warn("found profiler settings of %s left by a previous run, they will be restored on stop", id)
+		}
+	}
+
+	if original == nil {
+		var err error
+		if original, err = readProfilerSettings(ctx, t.db(), id); err != nil {
+			return err
+		}
+
+		if t.settingsStore != nil {
+			if err := t.settingsStore.Save(ctx, original); err != nil {
+				return fmt.Errorf("failed to save profiler settings %s: %w", id, err)
+			}
+		}
+	}
+
+	t.originalsLock.Lock()
+	t.originals[host] = original
+	t.originalsLock.Unlock()
+
+	return nil
+}
+
+// advance moves the checkpoint after the entry, returns false if the entry was already processed.
+func (t *tailer) advance(ts time.Time, hash int64) bool {
+	t.checkpointLock.Lock()
+	defer t.checkpointLock.Unlock()
+
+	if t.checkpoint.Processed(ts, hash) {
+		return false
+	}
+
+	t.checkpoint.Advance(ts, hash)
+	t.checkpointDirty = true
+
+	return true
+}
+
+// saveCheckpoint persists the checkpoint at most every PROFILER_CHECKPOINT_INTERVAL, unless forced.
+// Entries still being handled when the process dies are lost, which is fine since we can miss a few.
+func (t *tailer) saveCheckpoint(ctx context.Context, force bool) error {
+	if t.checkpoints == nil {
+		return nil
+	}
+
+	t.checkpointLock.Lock()
+	if !t.checkpointDirty || (!force && time.Since(t.checkpointSavedAt) < constant.PROFILER_CHECKPOINT_INTERVAL) {
+		t.checkpointLock.Unlock()
+		return nil
+	}
+
+	cp := *t.checkpoint
+	cp.Seen = append([]int64{}, t.checkpoint.Seen...)
+	t.checkpointDirty = false
+	t.checkpointSavedAt = time.Now()
+	t.checkpointLock.Unlock()
+
+	if err := t.checkpoints.Save(ctx, &cp); err != nil {
+		t.checkpointLock.Lock()
+		t.checkpointDirty = true
+		t.checkpointLock.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// setupProfiler enables the profiler on the node. system.profile can only be recreated with a bigger size on a
+// writable node, secondaries keep whatever collection they already have.
+func (t *tailer) setupProfiler(ctx context.Context) error {
+	if err := t.captureOriginalSettings(ctx); err != nil {
+		return err
+	}
+
+	hello, err := t.client.Hello(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !hello.Writable() {
+		return t.enableProfiler(ctx)
+	}
+
+	if t.currentSystemProfileSize == 0 { // Use what the profiler already recorded to pick a sensible size from the start
+		tp, err := observeSystemProfile(ctx, t.db())
+		if err != nil {
+			logger.Warn("failed to estimate %s throughput on %s: %v", constant.PROFILER_SYSTEM_PROFILE, t.source.Host, err)
+		} else {
+			t.throughput = tp
+		}
+	}
+
+	return t.ensureSystemProfileSize(ctx, t.systemProfileTargetSize(t.currentSystemProfileSize))
+}
+
+// increaseSystemProfileSize grows system.profile after we lost our position in it (i.e. it is too small to hold the
+// entries written while we were busy).
+func (t *tailer) increaseSystemProfileSize(ctx context.Context) error {
+	target := t.systemProfileTargetSize(t.currentSystemProfileSize * constant.PROFILER_SYSTEM_PROFILE_GROWTH_FACTOR)
+	if target <= t.currentSystemProfileSize {
+		return nil // Already at the maximum size
+	}
+
+	hello, err := t.client.Hello(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !hello.Writable() {
+		logger.Warn("cannot resize %s on %s since it isn't writable", constant.PROFILER_SYSTEM_PROFILE, t.source.Host)
+		return nil
+	}
+
+	return t.ensureSystemProfileSize(ctx, target)
+}
+
+// systemProfileTargetSize returns the size system.profile should have, given the observed throughput, without going
+// over PROFILER_SYSTEM_PROFILE_MAX_SIZE.
+func (t *tailer) systemProfileTargetSize(size int64) int64 {
+	if estimate := t.throughput.estimate(); estimate > size {
+		size = estimate
+	}
+
+	if size < constant.PROFILER_SYSTEM_PROFILE_MIN_SIZE {
+		size = constant.PROFILER_SYSTEM_PROFILE_MIN_SIZE
+	}
+
+	if size > constant.PROFILER_SYSTEM_PROFILE_MAX_SIZE {
+		systemProfileMaxSizeReached.Inc()
+		logger.Warn("%s on %s would need %v bytes, capping it to %v bytes: some entries will be lost", constant.PROFILER_SYSTEM_PROFILE, t.source.Host, size, constant.PROFILER_SYSTEM_PROFILE_MAX_SIZE)
+		size = constant.PROFILER_SYSTEM_PROFILE_MAX_SIZE
+	}
+
+	return size
+}
+
+// ensureSystemProfileSize recreates system.profile as a capped collection of the given size, unless the current one
+// is already large enough (no need to lose its content).
+func (t *tailer) ensureSystemProfileSize(ctx context.Context, size int64) error {
+	db := t.db()
+
+	exists, currentSize, err := systemProfileSize(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if exists && currentSize >= size {
+		t.currentSystemProfileSize = currentSize
+		logger.Info("keeping %s of %v bytes on %s", constant.PROFILER_SYSTEM_PROFILE, currentSize, t.source.Host)
+
+		return t.enableProfiler(ctx)
+	}
+
+	// Stop profiler - no problem if it fails
+	db.RunCommand(ctx, bson.M{
+		"profile": 0,
+	})
+
+	// Clean current profiling collection to make sure it is capped
+	if err := db.Collection(constant.PROFILER_SYSTEM_PROFILE).Drop(ctx); err != nil {
+		return fmt.Errorf("failed to drop collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+	}
+
+	createCollectionOptions := options.CreateCollectionOptions{}
+	createCollectionOptions.SetCapped(true)
+	createCollectionOptions.SetSizeInBytes(size)
+
+	if err := db.CreateCollection(ctx, constant.PROFILER_SYSTEM_PROFILE, &createCollectionOptions); err != nil {
+		if e, ok := err.(mongo.ServerError); ok {
+			if !e.HasErrorCode(constant.MONGO_COLLECTION_EXISTS_ERROR) {
+				return fmt.Errorf("failed to create collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+			}
+		} else {
+			return fmt.Errorf("failed to create collection %s: %w", constant.PROFILER_SYSTEM_PROFILE, err)
+		}
+	}
+
+	t.currentSystemProfileSize = size
+	logger.Info("resized %s to %v bytes on %s", constant.PROFILER_SYSTEM_PROFILE, size, t.source.Host)
+
+	return t.enableProfiler(ctx)
+}
+
+func (t *tailer) enableProfiler(ctx context.Context) error {
+	logger.Info("Setting profiler to level %v for database %s on %s", t.profilerLevel, t.database, t.source.Host)
+	logger.Info("Slow query threshold %vms", t.slowThresholdMS)
+
+	res := t.db().RunCommand(ctx, bson.D{
+		{Key: "profile", Value: t.profilerLevel},
+		{Key: "slowms", Value: t.slowThresholdMS},
+	})
+
+	if res.Err() != nil {
+		return fmt.Errorf("failed to start collector: %w", res.Err())
+	}
+
+	return nil
+}
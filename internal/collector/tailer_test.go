@@ -0,0 +1,45 @@
+package collector
+
+import (
+	"context"
+	"testing"
+
+	mgo "github.com/guillotjulien/mongo-profiler/internal/mongo"
+)
+
+func TestTailersFollowPrimary(t *testing.T) {
+	t.Parallel()
+
+	client, err := mgo.NewClient(context.Background(), "mongodb://node1:27017,node2:27017/app?replicaSet=rs0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := Source{Host: "node1:27017"}
+	tailers := []*tailer{
+		newTailer(client, source, "app", true, CollectorOptions{}),
+		newTailer(client, source, "billing", true, CollectorOptions{}),
+	}
+
+	if tailers[0].primaryChanged == nil || tailers[0].primaryChanged == tailers[1].primaryChanged {
+		t.Fatal("expected each tailer to have its own primary notifications")
+	}
+
+	for _, tailer := range tailers {
+		notifications := make(chan string, 1)
+		notifications <- "node2:27017"
+		tailer.primaryChanged = notifications
+
+		if !tailer.primaryMoved() || tailer.source.Host != "node2:27017" || !tailer.needsProfilerSetup {
+			t.Errorf("%s: expected to move to node2:27017, got %+v", tailer.database, tailer.source)
+		}
+		if tailer.primaryMoved() {
+			t.Errorf("%s: expected to stay on node2:27017", tailer.database)
+		}
+	}
+
+	member := newTailer(client, source, "app", false, CollectorOptions{})
+	if member.primaryMoved() {
+		t.Error("expected a tailer sticking to one member to never move")
+	}
+}
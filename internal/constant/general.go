@@ -4,3 +4,5 @@ import "time"
 
 const MAX_RETRY = 3
 const RETRY_AFTER = 10 * time.Second
+const MAX_RETRY_AFTER = 5 * time.Minute // RETRY_AFTER doubles at every failure up to this
+const METRICS_LOG_INTERVAL = time.Minute
@@ -8,3 +8,5 @@ const MONGO_COLLECTION_EXISTS_ERROR = 48
 const MONGO_INDEX_EXISTS_ERROR = 85
 const MONGO_DUPLICATE_DOCUMENT_ERROR = 11000
 const MONGO_CAPPED_POSITION_LOST_ERROR = 136
+const MONGO_COMMAND_NOT_FOUND_ERROR = 59
+const MONGO_NAMESPACE_NOT_FOUND_ERROR = 26
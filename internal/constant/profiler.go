@@ -1,8 +1,32 @@
 package constant
 
+import "time"
+
 const PROFILER_SYSTEM_PROFILE = "system.profile"
-const PROFILER_SYSTEM_PROFILE_CAPPED_INCREMENT = 1024 * 1024 // 1MB
-const PROFILER_SYSTEM_PROFILE_MAX_SIZE = 1024 * 1024 * 1024  // 1GB
+const PROFILER_SYSTEM_PROFILE_MIN_SIZE = 1024 * 1024        // 1MB
+const PROFILER_SYSTEM_PROFILE_MAX_SIZE = 1024 * 1024 * 1024 // 1GB
+const PROFILER_SYSTEM_PROFILE_GROWTH_FACTOR = 2
+const PROFILER_SYSTEM_PROFILE_RETENTION = time.Minute // How long entries should survive in system.profile (must cover a cursor recovery)
 const PROFILER_SLOWOPS_COLLECTION = "slowops"
+const PROFILER_SLOWOPS_SCHEMA_VERSION = 3 // Bump when the shape of slowops records changes
 const PROFILER_SLOWOPS_EXAMPLE_COLLECTION = "slowops.examples"
 const PROFILER_SLOWOPS_EXPIRE_SECONDS = 7884000 // 3 months
+const PROFILER_CHECKPOINT_COLLECTION = "checkpoints"
+const PROFILER_CHECKPOINT_INTERVAL = 5 * time.Second
+const PROFILER_WRITER_BATCH_SIZE = 500
+const PROFILER_WRITER_FLUSH_INTERVAL = time.Second
+const PROFILER_SETTINGS_COLLECTION = "profilersettings"
+const PROFILER_DATABASE_DISCOVERY_INTERVAL = time.Minute
+const PROFILER_CURSORS_COLLECTION = "cursors"
+const PROFILER_CURSOR_TIMEOUT = 10 * time.Minute // Default cursorTimeoutMillis of the server
+const PROFILER_ROLLUP_MINUTE_COLLECTION = "slowops.rollups.minute"
+const PROFILER_ROLLUP_MINUTE_EXPIRE_SECONDS = PROFILER_SLOWOPS_EXPIRE_SECONDS // 3 months, rollups must not expire before the raw records
+const PROFILER_ROLLUP_HOUR_COLLECTION = "slowops.rollups.hour"
+const PROFILER_ROLLUP_HOUR_EXPIRE_SECONDS = 31536000 // 1 year
+const PROFILER_SKETCH_RELATIVE_ACCURACY = 0.01       // Of the percentiles computed from sketches, changing it invalidates stored sketches
+const PROFILER_CURRENTOPS_COLLECTION = "currentops"
+const PROFILER_CURRENTOP_THRESHOLD = 10 * time.Second // Operations running for less time aren't recorded in currentops
+const PROFILER_KILL_AUDIT_COLLECTION = "currentops.kills"
+const PROFILER_COLLSCAN_PLAN_SUMMARY = "COLLSCAN" // Only a full scan, plans mixing it with index scans (e.g. $or) don't count
+const PROFILER_INDEXSTATS_COLLECTION = "indexstats"
+const PROFILER_INDEXSTATS_EXPIRE_SECONDS = 31536000 // 1 year
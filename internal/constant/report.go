@@ -0,0 +1,3 @@
+package constant
+
+const REPORT_MAX_EXAMPLES = 20 // Examples returned for a query shape (one per collection)
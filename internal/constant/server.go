@@ -0,0 +1,7 @@
+package constant
+
+import "time"
+
+const SERVER_LISTEN_ADDRESS = "localhost:8080" // The server has no authentication, only expose it deliberately
+const SERVER_SHUTDOWN_TIMEOUT = 10 * time.Second
+const SERVER_MAX_LIMIT = 200 // Rows returned by a single request
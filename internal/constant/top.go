@@ -0,0 +1,7 @@
+package constant
+
+import "time"
+
+const TOP_WINDOW = time.Minute
+const TOP_REFRESH_INTERVAL = time.Second
+const TOP_MAX_ENTRIES = 100000 // Kept in memory, oldest ones are dropped first
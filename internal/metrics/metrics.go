@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+)
+
+var registry sync.Map // name -> *Counter
+
+type Counter struct {
+	name  string
+	value int64
+}
+
+// NewCounter returns the counter registered under name, creating it if needed.
+func NewCounter(name string) *Counter {
+	c, _ := registry.LoadOrStore(name, &Counter{name: name})
+	return c.(*Counter)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Snapshot returns the current value of every registered counter.
+func Snapshot() map[string]int64 {
+	snapshot := map[string]int64{}
+	registry.Range(func(key, value any) bool {
+		snapshot[key.(string)] = value.(*Counter).Value()
+		return true
+	})
+	return snapshot
+}
+
+// Log prints the non-zero counters at every interval until the context is cancelled.
+func Log(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		snapshot := Snapshot()
+
+		names := make([]string, 0, len(snapshot))
+		for name, value := range snapshot {
+			if value != 0 {
+				names = append(names, name)
+			}
+		}
+
+		if len(names) == 0 {
+			continue
+		}
+
+		sort.Strings(names)
+
+		values := make([]string, 0, len(names))
+		for _, name := range names {
+			values = append(values, fmt.Sprintf("%s=%d", name, snapshot[name]))
+		}
+
+		logger.Info("metrics: %s", strings.Join(values, " "))
+	}
+}
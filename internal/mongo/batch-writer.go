@@ -0,0 +1,188 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BatchWriter accumulates documents and inserts them with a single unordered InsertMany once BatchSize documents are
+// pending or every FlushInterval. Since writes are deferred, Write never reports insertion errors: failures are logged
+// per document and counted, duplicates are silently ignored.
+type BatchWriter struct {
+	client        *Client
+	collection    string
+	batchSize     int
+	flushInterval time.Duration
+	ctx           context.Context
+	onInserted    func(doc bson.Raw)
+
+	lock    sync.Mutex
+	pending []interface{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	inserted   *metrics.Counter
+	duplicates *metrics.Counter
+	failed     *metrics.Counter
+}
+
+func NewBatchWriter(ctx context.Context, client *Client, collection string, batchSize int, flushInterval time.Duration) *BatchWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	w := &BatchWriter{}
+	w.client = client
+	w.collection = collection
+	w.batchSize = batchSize
+	w.flushInterval = flushInterval
+	w.ctx = ctx
+	w.done = make(chan struct{})
+	w.inserted = metrics.NewCounter(fmt.Sprintf("writer.%s.inserted", collection))
+	w.duplicates = metrics.NewCounter(fmt.Sprintf("writer.%s.duplicates", collection))
+	w.failed = metrics.NewCounter(fmt.Sprintf("writer.%s.failed", collection))
+
+	w.wg.Add(1)
+	go w.flushPeriodically()
+
+	return w
+}
+
+// OnInserted registers a function called with every document once it was inserted, and only then: documents that
+// failed or were already stored (e.g. read again after a restart) are skipped. It must be set before the first Write,
+// and may be called concurrently.
+func (w *BatchWriter) OnInserted(f func(doc bson.Raw)) {
+	w.onInserted = f
+}
+
+func (w *BatchWriter) Write(p []byte) (n int, err error) {
+	doc := append(bson.Raw(nil), p...) // Caller is free to reuse p
+	if err := doc.Validate(); err != nil {
+		return 0, fmt.Errorf("cannot write data: %w", err)
+	}
+
+	w.lock.Lock()
+	w.pending = append(w.pending, doc)
+	batch := w.takeBatch(false)
+	w.lock.Unlock()
+
+	if batch != nil {
+		w.insert(w.ctx, batch)
+	}
+
+	return len(p), nil
+}
+
+// Flush inserts every pending document.
+func (w *BatchWriter) Flush(ctx context.Context) {
+	w.lock.Lock()
+	batch := w.takeBatch(true)
+	w.lock.Unlock()
+
+	if batch != nil {
+		w.insert(ctx, batch)
+	}
+}
+
+// Close stops the periodic flush and inserts every pending document. Nothing can be written afterwards.
+func (w *BatchWriter) Close(ctx context.Context) {
+	close(w.done)
+	w.wg.Wait()
+
+	w.Flush(ctx)
+}
+
+func (w *BatchWriter) flushPeriodically() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.Flush(w.ctx)
+		}
+	}
+}
+
+// takeBatch must be called with the lock held.
+func (w *BatchWriter) takeBatch(force bool) []interface{} {
+	if len(w.pending) == 0 || (!force && len(w.pending) < w.batchSize) {
+		return nil
+	}
+
+	batch := w.pending
+	w.pending = nil
+
+	return batch
+}
+
+func (w *BatchWriter) insert(ctx context.Context, batch []interface{}) {
+	opts := options.InsertMany()
+	opts.SetOrdered(false) // Keep going when a document fails (most likely a duplicate)
+
+	_, err := w.client.GetDefaultDatabase().Collection(w.collection).InsertMany(ctx, batch, opts)
+	if err == nil {
+		w.inserted.Add(int64(len(batch)))
+		w.notifyInserted(batch, nil)
+		return
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		w.failed.Add(int64(len(batch)))
+		logger.Warn("failed to insert %v documents in %s: %v", len(batch), w.collection, err)
+		return
+	}
+
+	w.inserted.Add(int64(len(batch) - len(bulkErr.WriteErrors))) // InsertedIDs lists every document sent
+	notInserted := map[int]bool{}
+	for _, writeErr := range bulkErr.WriteErrors {
+		notInserted[writeErr.Index] = true
+
+		if writeErr.Code == constant.MONGO_DUPLICATE_DOCUMENT_ERROR {
+			w.duplicates.Inc()
+			continue
+		}
+
+		w.failed.Inc()
+
+		var id interface{}
+		if writeErr.Index < len(batch) {
+			id = batch[writeErr.Index].(bson.Raw).Lookup("_id")
+		}
+		logger.Warn("failed to insert document %v in %s: %s", id, w.collection, writeErr.Message)
+	}
+
+	if bulkErr.WriteConcernError != nil {
+		logger.Warn("write concern error while inserting %v documents in %s: %v", len(batch), w.collection, bulkErr.WriteConcernError)
+	}
+
+	w.notifyInserted(batch, notInserted)
+}
+
+func (w *BatchWriter) notifyInserted(batch []interface{}, notInserted map[int]bool) {
+	if w.onInserted == nil {
+		return
+	}
+
+	for i, doc := range batch {
+		if !notInserted[i] {
+			w.onInserted(doc.(bson.Raw))
+		}
+	}
+}
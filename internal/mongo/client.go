@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/guillotjulien/mongo-profiler/internal/constant"
 	"github.com/guillotjulien/mongo-profiler/internal/logger"
 
 	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/description"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 )
@@ -17,6 +21,10 @@ import (
 type Client struct {
 	C       *mongo.Client
 	Connstr connstring.ConnString
+
+	primaryLock      sync.RWMutex
+	primary          string
+	primaryListeners []chan string
 }
 
 func NewClient(ctx context.Context, uri string) (client *Client, err error) {
@@ -32,6 +40,67 @@ func NewClient(ctx context.Context, uri string) (client *Client, err error) {
 	opt := options.Client()
 	opt.ApplyURI(uri)
 
+	return newClient(connstr, opt)
+}
+
+// NewMemberClient creates a client connected directly to a single member of the installation, bypassing server
+// selection so that we can talk to secondaries. It reuses the credentials and options of the original URI.
+func (client *Client) NewMemberClient(host string) (*Client, error) {
+	return client.derive([]string{host}, "")
+}
+
+// NewShardClient creates a client connected to the replica set backing a shard, reusing the credentials and options
+// of the original URI (which points to a mongos).
+func (client *Client) NewShardClient(shard Shard) (*Client, error) {
+	replicaSet, hosts := shard.ReplicaSet()
+
+	return client.derive(hosts, replicaSet)
+}
+
+// derive creates a client with the same URI as the current one but different hosts. Without a replica set name, the
+// client is connected directly to the single host.
+func (client *Client) derive(hosts []string, replicaSet string) (*Client, error) {
+	uri, err := url.Parse(client.Connstr.Original)
+	if err != nil {
+		return nil, err
+	}
+
+	query := uri.Query()
+	if uri.Scheme == connstring.SchemeMongoDBSRV { // Hosts are listed explicitly, so make the implicit SRV options explicit
+		if !query.Has("tls") && !query.Has("ssl") {
+			query.Set("tls", "true")
+		}
+		if !query.Has("authSource") && client.Connstr.AuthSource != "" {
+			query.Set("authSource", client.Connstr.AuthSource)
+		}
+		query.Del("srvServiceName")
+		query.Del("srvMaxHosts")
+	}
+
+	if replicaSet != "" {
+		query.Set("replicaSet", replicaSet)
+		query.Del("directConnection")
+	} else {
+		query.Del("replicaSet")
+		query.Set("directConnection", "true")
+	}
+
+	uri.Scheme = connstring.SchemeMongoDB
+	uri.Host = strings.Join(hosts, ",")
+	uri.RawQuery = query.Encode()
+
+	connstr, err := connstring.ParseAndValidate(uri.String())
+	if err != nil {
+		return nil, err
+	}
+
+	opt := options.Client()
+	opt.ApplyURI(uri.String())
+
+	return newClient(connstr, opt)
+}
+
+func newClient(connstr connstring.ConnString, opt *options.ClientOptions) (client *Client, err error) {
 	if !connstr.ConnectTimeoutSet { // Set a sensible timeout
 		opt.SetConnectTimeout(constant.MONGO_CONNECT_TIMEOUT)
 		opt.SetServerSelectionTimeout(constant.MONGO_CONNECT_TIMEOUT)
@@ -55,15 +124,25 @@ func NewClient(ctx context.Context, uri string) (client *Client, err error) {
 
 	opt.SetMonitor(cmdMonitor)
 
+	client = &Client{
+		Connstr: connstr,
+	}
+
+	serverMonitor := &event.ServerMonitor{
+		// Called with the topology locked, so we must not run any operation from here
+		TopologyDescriptionChanged: func(evt *event.TopologyDescriptionChangedEvent) {
+			client.setPrimary(primaryAddress(evt.NewDescription))
+		},
+	}
+
+	opt.SetServerMonitor(serverMonitor)
+
 	c, err := mongo.NewClient(opt)
 	if err != nil {
 		return nil, err
 	}
 
-	client = &Client{
-		C:       c,
-		Connstr: connstr,
-	}
+	client.C = c
 
 	return client, nil
 }
@@ -97,3 +176,63 @@ func (client *Client) Equal(cmpClient *Client) bool {
 func (client *Client) GetDefaultDatabase() *mongo.Database {
 	return client.C.Database(client.Connstr.Database)
 }
+
+// Primary returns the address of the last known writable server (primary for a replica set, the server itself for a standalone).
+func (client *Client) Primary() string {
+	client.primaryLock.RLock()
+	defer client.primaryLock.RUnlock()
+
+	return client.primary
+}
+
+// PrimaryChanged notifies the address of the new writable server each time the driver detects a stepdown / election.
+// Every call returns a new channel so that each listener (e.g. the tailer of each database) is notified. Only the
+// latest address is kept while a listener isn't reading.
+func (client *Client) PrimaryChanged() <-chan string {
+	listener := make(chan string, 1)
+
+	client.primaryLock.Lock()
+	client.primaryListeners = append(client.primaryListeners, listener)
+	client.primaryLock.Unlock()
+
+	return listener
+}
+
+func (client *Client) setPrimary(addr string) {
+	if addr == "" { // Election in progress, wait until the new primary is known
+		return
+	}
+
+	client.primaryLock.Lock()
+	changed := client.primary != addr
+	client.primary = addr
+	listeners := client.primaryListeners
+	client.primaryLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	logger.Trace("writable server is now %s", addr)
+
+	for _, listener := range listeners {
+		select { // Drop the previous notification if it wasn't consumed yet
+		case <-listener:
+		default:
+		}
+
+		select {
+		case listener <- addr:
+		default:
+		}
+	}
+}
+
+func primaryAddress(topology description.Topology) string {
+	for _, server := range topology.Servers {
+		if server.Kind == description.RSPrimary || server.Kind == description.Standalone {
+			return server.Addr.String()
+		}
+	}
+	return ""
+}
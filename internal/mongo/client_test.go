@@ -0,0 +1,34 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPrimaryChangedNotifiesEveryListener(t *testing.T) {
+	t.Parallel()
+
+	client, err := NewClient(context.Background(), "mongodb://node1:27017,node2:27017/app?replicaSet=rs0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. the tailers of two databases following the primary
+	app := client.PrimaryChanged()
+	billing := client.PrimaryChanged()
+
+	client.setPrimary("node1:27017")
+	client.setPrimary("") // Election in progress
+	client.setPrimary("node2:27017")
+
+	for name, listener := range map[string]<-chan string{"app": app, "billing": billing} {
+		select {
+		case primary := <-listener:
+			if primary != "node2:27017" {
+				t.Errorf("%s: expected the latest primary node2:27017, got %v", name, primary)
+			}
+		default:
+			t.Errorf("%s: expected to be notified of the new primary", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type HelloResult struct {
+	IsWritablePrimary bool     `bson:"isWritablePrimary"`
+	IsMaster          bool     `bson:"ismaster"` // Legacy name of isWritablePrimary (servers before 4.4.2)
+	Secondary         bool     `bson:"secondary"`
+	SetName           string   `bson:"setName"`
+	Hosts             []string `bson:"hosts"`
+	Passives          []string `bson:"passives"`
+	Me                string   `bson:"me"`
+	Msg               string   `bson:"msg"` // "isdbgrid" when talking to a mongos
+}
+
+func (r *HelloResult) Writable() bool {
+	return r.IsWritablePrimary || r.IsMaster
+}
+
+// IsMongos tells whether the server answering the hello command is a mongos router.
+func (r *HelloResult) IsMongos() bool {
+	return r.Msg == "isdbgrid"
+}
+
+// Hello runs the hello command (or isMaster for older servers) against the server selected by the client.
+func (client *Client) Hello(ctx context.Context) (*HelloResult, error) {
+	admin := client.C.Database("admin")
+
+	res := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}})
+	if e, ok := res.Err().(mongo.ServerError); ok && e.HasErrorCode(constant.MONGO_COMMAND_NOT_FOUND_ERROR) {
+		res = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}})
+	}
+
+	if res.Err() != nil {
+		return nil, fmt.Errorf("failed to run hello command: %w", res.Err())
+	}
+
+	result := &HelloResult{}
+	if err := res.Decode(result); err != nil {
+		return nil, fmt.Errorf("failed to decode hello response: %w", err)
+	}
+
+	return result, nil
+}
+
+// Members lists the data bearing members of the replica set the client is connected to. Arbiters are skipped since
+// they don't hold data and hidden members are skipped since they never receive reads.
+// A standalone server is its own single member.
+func (client *Client) Members(ctx context.Context) ([]string, error) {
+	hello, err := client.Hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	members := append([]string{}, hello.Hosts...)
+	members = append(members, hello.Passives...)
+
+	if len(members) == 0 {
+		if primary := client.Primary(); primary != "" {
+			members = append(members, primary)
+		} else {
+			members = append(members, client.Connstr.Hosts...)
+		}
+	}
+
+	return members, nil
+}
@@ -0,0 +1,41 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type Shard struct {
+	ID   string `bson:"_id"`
+	Host string `bson:"host"` // e.g. rs0/host1:27017,host2:27017
+}
+
+// ReplicaSet splits the shard host string into the replica set name and its seed list.
+func (s Shard) ReplicaSet() (string, []string) {
+	name, hosts, found := strings.Cut(s.Host, "/")
+	if !found { // Standalone shard
+		return "", strings.Split(s.Host, ",")
+	}
+
+	return name, strings.Split(hosts, ",")
+}
+
+// Shards lists the shards of the cluster. Only works when connected to a mongos.
+func (client *Client) Shards(ctx context.Context) ([]Shard, error) {
+	res := client.C.Database("admin").RunCommand(ctx, bson.D{{Key: "listShards", Value: 1}})
+	if res.Err() != nil {
+		return nil, fmt.Errorf("failed to list shards: %w", res.Err())
+	}
+
+	var result struct {
+		Shards []Shard `bson:"shards"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode shards list: %w", err)
+	}
+
+	return result.Shards, nil
+}
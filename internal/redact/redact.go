@@ -0,0 +1,291 @@
+// Package redact removes literal values (emails, tokens, customer IDs...) from the profile documents we store as
+// examples, while keeping the structure of the query readable.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/guillotjulien/mongo-profiler/internal/shape"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+type Mode string
+
+const (
+	ModeOff         Mode = "off"
+	ModeHash        Mode = "hash"        // Literals are replaced by a keyed hash, so that equal values can still be spotted
+	ModePlaceholder Mode = "placeholder" // Literals are replaced by their type, e.g. "?string"
+	ModeAllowList   Mode = "allowlist"   // Literals of the allowed fields are kept, others are replaced by their type
+)
+
+// Fields of the profile document holding user provided values
+var redactedFields = map[string]bool{
+	"command": true, "originatingCommand": true, "updateobj": true, "query": true, "errMsg": true,
+}
+
+// Fields of a command that only hold field names or options
+var structuralFields = map[string]bool{
+	"sort": true, "hint": true, "collation": true, "key": true, "$db": true,
+}
+
+// Fields of a command holding a projection: inclusion flags are kept, operator arguments ($elemMatch, $slice) are not
+var projectionFields = map[string]bool{"projection": true, "fields": true}
+
+// Fields of a command holding documents / predicates: field names start from there
+var containerFields = map[string]bool{
+	"filter": true, "query": true, "q": true, "u": true, "update": true, "documents": true, "updates": true,
+	"deletes": true, "pipeline": true,
+}
+
+// Fields holding aggregation expressions, where strings starting with $ are field paths or variables. Everywhere else
+// (filters, update operators, documents), they are literals like any other, e.g. a bcrypt hash or "$100".
+var expressionFields = map[string]bool{"$expr": true, "pipeline": true, "let": true}
+
+// Fields of an expression holding literals again: the filter of a $match stage, the argument of $literal
+var literalFields = map[string]bool{"$match": true, "$literal": true, "filter": true, "query": true, "q": true}
+
+// Rule defines how literals of the namespaces matching Namespace (e.g. "app.users" or "app.*") are redacted.
+type Rule struct {
+	Namespace string
+	Mode      Mode
+	Fields    map[string]bool // Allowed field paths, for ModeAllowList
+
+	key []byte // Of the Redactor, for ModeHash
+}
+
+type Redactor struct {
+	Default Mode
+	Rules   []Rule // First matching rule wins
+	Key     []byte // Keys the hashes of ModeHash, so that they can't be reversed by hashing likely values
+}
+
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeOff, ModeHash, ModePlaceholder, ModeAllowList:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown redaction mode %q (expected %s, %s, %s or %s)", s, ModeOff, ModeHash, ModePlaceholder, ModeAllowList)
+}
+
+// ParseRules reads rules formatted as <namespace>=<mode>[:<field>,<field>] separated by semicolons, e.g.
+// "app.users=allowlist:status,country;app.logs=off".
+func ParseRules(s string) ([]Rule, error) {
+	rules := []Rule{}
+
+	for _, spec := range strings.Split(s, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		namespace, modeSpec, found := strings.Cut(spec, "=")
+		if !found || namespace == "" {
+			return nil, fmt.Errorf("invalid redaction rule %q (expected <namespace>=<mode>)", spec)
+		}
+
+		if _, err := path.Match(namespace, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %w", namespace, err)
+		}
+
+		modeName, fieldList, _ := strings.Cut(modeSpec, ":")
+		mode, err := ParseMode(modeName)
+		if err != nil {
+			return nil, err
+		}
+
+		rule := Rule{Namespace: namespace, Mode: mode, Fields: map[string]bool{}}
+		for _, field := range strings.Split(fieldList, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				rule.Fields[field] = true
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Hashes tells whether any namespace is redacted with ModeHash.
+func (r *Redactor) Hashes() bool {
+	if r == nil {
+		return false
+	}
+
+	for _, rule := range r.Rules {
+		if rule.Mode == ModeHash {
+			return true
+		}
+	}
+
+	return r.Default == ModeHash
+}
+
+func (r *Redactor) rule(ns string) Rule {
+	if r == nil {
+		return Rule{Mode: ModeOff}
+	}
+
+	for _, rule := range r.Rules {
+		if matched, _ := path.Match(rule.Namespace, ns); matched {
+			rule.key = r.Key
+			return rule
+		}
+	}
+
+	return Rule{Namespace: ns, Mode: r.Default, key: r.Key}
+}
+
+// Redact returns the profile document with the literals of command, originatingCommand, updateobj, query (before
+// MongoDB 3.6) and errMsg (e.g. the dup key of E11000 errors) redacted according to the rule of the namespace. A nil
+// Redactor keeps the document as is.
+func (r *Redactor) Redact(ns string, document bson.Raw) (bson.Raw, error) {
+	rule := r.rule(ns)
+	if rule.Mode == ModeOff || rule.Mode == "" {
+		return document, nil
+	}
+
+	elements, err := document.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	redacted := bson.D{}
+	for _, el := range elements {
+		key, val := el.Key(), el.Value()
+
+		doc, ok := val.DocumentOK()
+		switch {
+		case !redactedFields[key]:
+			redacted = append(redacted, bson.E{Key: key, Value: val})
+		case !ok || key == "updateobj" || key == "query":
+			redacted = append(redacted, bson.E{Key: key, Value: rule.value(val, "", false)})
+		default:
+			redacted = append(redacted, bson.E{Key: key, Value: rule.command(doc)})
+		}
+	}
+
+	return bson.Marshal(redacted)
+}
+
+func (rule Rule) command(command bson.Raw) bson.D {
+	redacted := bson.D{}
+
+	elements, _ := command.Elements()
+	for i, el := range elements {
+		key, val := el.Key(), el.Value()
+
+		// Command name, e.g. find: "collection". $truncated holds the whole command serialized as a string.
+		if (i == 0 && val.Type == bsontype.String && !strings.HasPrefix(key, "$")) || structuralFields[key] {
+			redacted = append(redacted, bson.E{Key: key, Value: val})
+			continue
+		}
+
+		if projectionFields[key] {
+			redacted = append(redacted, bson.E{Key: key, Value: rule.projection(val, "")})
+			continue
+		}
+
+		redacted = append(redacted, bson.E{Key: key, Value: rule.value(val, "", expression(key, val, false))})
+	}
+
+	return redacted
+}
+
+// projection keeps the projected fields and their inclusion flags, and redacts the arguments of operators.
+func (rule Rule) projection(val bson.RawValue, field string) interface{} {
+	doc, ok := val.DocumentOK()
+	if !ok {
+		if val.Type == bsontype.String { // Literal value of MongoDB 4.4+ projections, unless it's a field path
+			return rule.value(val, field, true)
+		}
+		return val // 1, 0, true or false
+	}
+
+	redacted := bson.D{}
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		key := el.Key()
+
+		switch {
+		case key == "$meta":
+			redacted = append(redacted, bson.E{Key: key, Value: el.Value()})
+		case strings.HasPrefix(key, "$"):
+			redacted = append(redacted, bson.E{Key: key, Value: rule.value(el.Value(), field, false)}) // $elemMatch filter, $slice numbers
+		default:
+			redacted = append(redacted, bson.E{Key: key, Value: rule.projection(el.Value(), strings.TrimPrefix(field+"."+key, "."))})
+		}
+	}
+
+	return redacted
+}
+
+// value redacts every literal under val. field is the path of the document field the value belongs to (operators
+// are not part of the path), used by the allow-list. Strings starting with $ are only kept in expressions.
+func (rule Rule) value(val bson.RawValue, field string, inExpression bool) interface{} {
+	switch val.Type {
+	case bsontype.EmbeddedDocument:
+		redacted := bson.D{}
+		elements, _ := val.Document().Elements()
+		for _, el := range elements {
+			key := el.Key()
+
+			childField := field
+			if containerFields[key] && field == "" {
+				childField = ""
+			} else if !strings.HasPrefix(key, "$") {
+				childField = strings.TrimPrefix(field+"."+key, ".")
+			}
+
+			redacted = append(redacted, bson.E{Key: key, Value: rule.value(el.Value(), childField, expression(key, el.Value(), inExpression))})
+		}
+		return redacted
+	case bsontype.Array:
+		redacted := bson.A{}
+		values, _ := val.Array().Values()
+		for _, v := range values {
+			redacted = append(redacted, rule.value(v, field, inExpression))
+		}
+		return redacted
+	case bsontype.String:
+		if inExpression && strings.HasPrefix(val.StringValue(), "$") { // Field path or variable
+			return val
+		}
+	}
+
+	return rule.literal(val, field)
+}
+
+// expression tells whether the value of key is an aggregation expression, given whether its parent is one.
+func expression(key string, val bson.RawValue, inExpression bool) bool {
+	switch {
+	case expressionFields[key], (key == "u" || key == "update") && val.Type == bsontype.Array: // Pipeline update
+		return true
+	case literalFields[key]:
+		return false
+	}
+
+	return inExpression
+}
+
+func (rule Rule) literal(val bson.RawValue, field string) interface{} {
+	switch rule.Mode {
+	case ModeHash:
+		mac := hmac.New(sha256.New, rule.key)
+		mac.Write([]byte{byte(val.Type)})
+		mac.Write(val.Value)
+		return "#" + hex.EncodeToString(mac.Sum(nil)[:16])
+	case ModeAllowList:
+		if rule.Fields[field] {
+			return val
+		}
+	}
+
+	return shape.Placeholder(val)
+}
@@ -0,0 +1,150 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const profileEntry = `{
+	"op": "query",
+	"ns": "app.users",
+	"command": {"find": "users", "filter": {"email": "jane@example.com", "status": "active", "age": {"$gt": 18}}, "sort": {"age": 1}, "$db": "app"},
+	"millis": 120
+}`
+
+func redact(t *testing.T, r *Redactor) string {
+	t.Helper()
+
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(profileEntry), false, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	redacted, err := r.Redact("app.users", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return redacted.String()
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	if out := redact(t, nil); !strings.Contains(out, "jane@example.com") {
+		t.Errorf("nil redactor should keep the document as is, got %s", out)
+	}
+
+	out := redact(t, &Redactor{Default: ModePlaceholder})
+	if strings.Contains(out, "jane@example.com") || strings.Contains(out, "active") {
+		t.Errorf("placeholder mode should remove literals, got %s", out)
+	}
+	if !strings.Contains(out, `"email": "?string"`) || !strings.Contains(out, `"find": "users"`) || !strings.Contains(out, `"millis": {"$numberInt":"120"}`) {
+		t.Errorf("placeholder mode should keep the structure, got %s", out)
+	}
+
+	hashed := redact(t, &Redactor{Default: ModeHash})
+	if strings.Contains(hashed, "jane@example.com") || hashed != redact(t, &Redactor{Default: ModeHash}) {
+		t.Errorf("hash mode should replace literals by a stable hash, got %s", hashed)
+	}
+
+	rules, err := ParseRules("other.*=off; app.*=allowlist:status,age")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = redact(t, &Redactor{Default: ModeOff, Rules: rules})
+	if strings.Contains(out, "jane@example.com") || !strings.Contains(out, `"status": "active"`) || !strings.Contains(out, `"$gt": {"$numberInt":"18"}`) {
+		t.Errorf("allow-list mode should only keep allowed fields, got %s", out)
+	}
+}
+
+func TestRedactLeaks(t *testing.T) {
+	t.Parallel()
+
+	var doc bson.Raw
+	err := bson.UnmarshalExtJSON([]byte(`{
+		"op": "query",
+		"ns": "app.users",
+		"command": {"$truncated": "{ find: \"users\", filter: { email: \"jane@example.com\" } }", "comment": "export"},
+		"originatingCommand": {"find": "users", "projection": {"orders": {"$elemMatch": {"sku": "jane@example.com"}}, "name": 1}},
+		"query": {"email": "jane@example.com"},
+		"errMsg": "E11000 duplicate key error collection: app.users index: email_1 dup key: { email: \"jane@example.com\" }"
+	}`), false, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redacted, err := (&Redactor{Default: ModePlaceholder}).Redact("app.users", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := redacted.String()
+	if strings.Contains(out, "jane@example.com") {
+		t.Errorf("literals should be redacted everywhere, got %s", out)
+	}
+	if !strings.Contains(out, `"name": {"$numberInt":"1"}`) || !strings.Contains(out, `"sku": "?string"`) {
+		t.Errorf("projections should keep their structure, got %s", out)
+	}
+}
+
+func TestRedactHashKey(t *testing.T) {
+	t.Parallel()
+
+	key1 := redact(t, &Redactor{Default: ModeHash, Key: []byte("key1")})
+	if key1 != redact(t, &Redactor{Default: ModeHash, Key: []byte("key1")}) {
+		t.Error("hashes with the same key should be stable")
+	}
+	if key1 == redact(t, &Redactor{Default: ModeHash, Key: []byte("key2")}) {
+		t.Error("hashes should depend on the key")
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	t.Parallel()
+
+	for _, invalid := range []string{"app.users", "app.users=secret", "[=off"} {
+		if _, err := ParseRules(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRedactDollarLiterals(t *testing.T) {
+	t.Parallel()
+
+	var doc bson.Raw
+	err := bson.UnmarshalExtJSON([]byte(`{
+		"op": "command",
+		"ns": "app.users",
+		"command": {
+			"aggregate": "users",
+			"pipeline": [
+				{"$match": {"password": "$2b$10$secrethash", "$expr": {"$gt": ["$spent", "$budget"]}}},
+				{"$project": {"total": {"$add": ["$price", {"$literal": "$100"}]}}}
+			]
+		},
+		"originatingCommand": {"find": "users", "filter": {"price": "$100"}, "projection": {"total": "$price"}}
+	}`), false, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redacted, err := (&Redactor{Default: ModePlaceholder}).Redact("app.users", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := redacted.String()
+	if strings.Contains(out, "secrethash") || strings.Contains(out, "$100") {
+		t.Errorf("strings starting with $ should be redacted outside expressions, got %s", out)
+	}
+	for _, path := range []string{`"$spent"`, `"$budget"`, `"$price"`, `"total": "$price"`} {
+		if !strings.Contains(out, path) {
+			t.Errorf("expected field path %s to be kept in expressions, got %s", path, out)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	FORMAT_TABLE = "table"
+	FORMAT_JSON  = "json"
+	FORMAT_CSV   = "csv"
+)
+
+// Write prints the result as an aligned table, a JSON array of objects or CSV with a header.
+func Write(w io.Writer, result *Result, format string) error {
+	switch format {
+	case FORMAT_TABLE:
+		return writeTable(w, result)
+	case FORMAT_JSON:
+		return writeJSON(w, result)
+	case FORMAT_CSV:
+		return writeCSV(w, result)
+	default:
+		return fmt.Errorf("unknown format %q (%s, %s or %s)", format, FORMAT_TABLE, FORMAT_JSON, FORMAT_CSV)
+	}
+}
+
+func writeTable(w io.Writer, result *Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join(result.Columns, "\t"))
+	for _, row := range result.Rows {
+		fmt.Fprintln(tw, strings.Join(cells(row), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// Objects returns a map per row, keyed by column, ready to be encoded in JSON.
+func (result *Result) Objects() []map[string]interface{} {
+	objects := make([]map[string]interface{}, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		object := map[string]interface{}{}
+		for i, column := range result.Columns {
+			value := row[i]
+			if f, ok := value.(float64); ok && math.IsNaN(f) { // Not valid JSON
+				value = nil
+			}
+			object[column] = value
+		}
+		objects = append(objects, object)
+	}
+
+	return objects
+}
+
+func writeJSON(w io.Writer, result *Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(result.Objects())
+}
+
+func writeCSV(w io.Writer, result *Result) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(result.Columns); err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		if err := cw.Write(cells(row)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func cells(row []interface{}) []string {
+	cells := make([]string, len(row))
+	for i, value := range row {
+		if f, ok := value.(float64); ok && math.IsNaN(f) {
+			cells[i] = ""
+			continue
+		}
+		cells[i] = fmt.Sprint(value)
+	}
+
+	return cells
+}
@@ -0,0 +1,45 @@
+package report
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	t.Parallel()
+
+	result := &Result{
+		Columns: []string{"queryHash", "count", "p99MS"},
+		Rows: [][]interface{}{
+			{"FFF0C0D3", int64(12), 250.5},
+			{"0000ABCD", int64(1), math.NaN()},
+		},
+	}
+
+	tests := map[string]string{
+		FORMAT_TABLE: "queryHash  count  p99MS\nFFF0C0D3   12     250.5\n0000ABCD   1      \n",
+		FORMAT_CSV:   "queryHash,count,p99MS\nFFF0C0D3,12,250.5\n0000ABCD,1,\n",
+		FORMAT_JSON:  `[{"count":12,"p99MS":250.5,"queryHash":"FFF0C0D3"},{"count":1,"p99MS":null,"queryHash":"0000ABCD"}]`,
+	}
+
+	for format, expected := range tests {
+		buf := &bytes.Buffer{}
+		if err := Write(buf, result, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		actual := buf.String()
+		if format == FORMAT_JSON {
+			actual = strings.Join(strings.Fields(actual), "")
+		}
+		if actual != expected {
+			t.Errorf("%s: expected\n%q\ngot\n%q", format, expected, actual)
+		}
+	}
+
+	if err := Write(&bytes.Buffer{}, result, "xml"); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
@@ -0,0 +1,400 @@
+// Package report runs the reports on the slow ops stored by the collector.
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/collector"
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInvalidOptions is returned when the report doesn't exist or doesn't support the options.
+var ErrInvalidOptions = errors.New("invalid report options")
+
+type Options struct {
+	Since      time.Time
+	Until      time.Time
+	Collection string // Namespace, e.g. app.users
+	User       string
+	Sort       string // Column to sort on, each report has its own default
+	Limit      int
+	Offset     int // Rows to skip, for pagination
+}
+
+// Result is a table, rows hold a value for each column.
+type Result struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+type runner func(ctx context.Context, db *mongo.Database, opts Options) (*Result, error)
+
+type definition struct {
+	description string
+	sorts       map[string]string // Sort option -> field sorted on (descending)
+	defaultSort string
+	run         runner
+}
+
+var reports = map[string]definition{
+	"shapes": {
+		description: "Query shapes by total duration, with percentiles",
+		sorts:       map[string]string{"total": "sumDurationMS", "count": "count", "avg": "avgDurationMS", "max": "maxDurationMS"},
+		defaultSort: "total",
+		run:         shapes,
+	},
+	"users": {
+		description: "Users by total duration",
+		sorts:       map[string]string{"total": "sumDurationMS", "count": "count", "avg": "avgDurationMS", "max": "maxDurationMS"},
+		defaultSort: "total",
+		run:         groupedBy("user"),
+	},
+	"collections": {
+		description: "Collections by total duration",
+		sorts:       map[string]string{"total": "sumDurationMS", "count": "count", "avg": "avgDurationMS", "max": "maxDurationMS"},
+		defaultSort: "total",
+		run:         groupedBy("collection"),
+	},
+	"collscan": {
+		description: "Query shapes running without index (COLLSCAN)",
+		sorts:       map[string]string{"total": "sumDurationMS", "count": "count", "examined": "docsExamined"},
+		defaultSort: "total",
+		run:         collscans,
+	},
+	"plans": {
+		description: "Plans by total duration",
+		sorts:       map[string]string{"total": "sumDurationMS", "count": "count", "examined": "docsExamined"},
+		defaultSort: "total",
+		run:         plans,
+	},
+	"examples": {
+		description: "Slowest operations, with the shape of their query",
+		sorts:       map[string]string{"duration": "durationMS", "examined": "docsExamined", "returned": "nreturned"},
+		defaultSort: "duration",
+		run:         examples,
+	},
+}
+
+// Names returns the available reports with their description.
+func Names() map[string]string {
+	names := map[string]string{}
+	for name, report := range reports {
+		names[name] = report.description
+	}
+	return names
+}
+
+// Run runs the named report against the internal database.
+func Run(ctx context.Context, db *mongo.Database, name string, opts Options) (*Result, error) {
+	report, ok := reports[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown report %q", ErrInvalidOptions, name)
+	}
+
+	if opts.Sort == "" {
+		opts.Sort = report.defaultSort
+	}
+	field, ok := report.sorts[opts.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: report %s cannot be sorted by %q (%s)", ErrInvalidOptions, name, opts.Sort, strings.Join(sortedKeys(report.sorts), ", "))
+	}
+	opts.Sort = field
+
+	if opts.Until.IsZero() {
+		opts.Until = time.Now()
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 10
+	}
+
+	return report.run(ctx, db, opts)
+}
+
+// shapes uses the rollups (minute ones when they cover the range) and merges their sketches for the percentiles.
+func shapes(ctx context.Context, db *mongo.Database, opts Options) (*Result, error) {
+	rollups, granularity := rollupCollection(db, opts.Since)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: rollupFilter(opts, granularity)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "queryHash", Value: "$queryHash"}, {Key: "collection", Value: "$collection"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+			{Key: "sumDurationMS", Value: bson.D{{Key: "$sum", Value: "$sumDurationMS"}}},
+			{Key: "maxDurationMS", Value: bson.D{{Key: "$max", Value: "$maxDurationMS"}}},
+			{Key: "docsExamined", Value: bson.D{{Key: "$sum", Value: "$docsExamined"}}},
+		}}},
+		{{Key: "$addFields", Value: bson.D{{Key: "avgDurationMS", Value: bson.D{{Key: "$divide", Value: bson.A{"$sumDurationMS", "$count"}}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: opts.Sort, Value: -1}}}},
+		{{Key: "$skip", Value: opts.Offset}},
+		{{Key: "$limit", Value: opts.Limit}},
+	}
+
+	rows := []struct {
+		ID struct {
+			QueryHash  string `bson:"queryHash"`
+			Collection string `bson:"collection"`
+		} `bson:"_id"`
+		Count         int64   `bson:"count"`
+		SumDurationMS int64   `bson:"sumDurationMS"`
+		AvgDurationMS float64 `bson:"avgDurationMS"`
+		MaxDurationMS int64   `bson:"maxDurationMS"`
+		DocExamined   int64   `bson:"docsExamined"`
+	}{}
+	if err := aggregate(ctx, rollups, pipeline, &rows); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: []string{"queryHash", "collection", "count", "totalMS", "avgMS", "p50MS", "p90MS", "p99MS", "maxMS", "docsExamined"}}
+	for _, row := range rows {
+		filter := rollupFilter(opts, granularity)
+		filter = append(filter, bson.E{Key: "queryHash", Value: row.ID.QueryHash}, bson.E{Key: "collection", Value: row.ID.Collection})
+
+		durations, err := collector.MergeDurations(ctx, rollups, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge durations of %s: %w", row.ID.QueryHash, err)
+		}
+
+		result.Rows = append(result.Rows, []interface{}{
+			row.ID.QueryHash, row.ID.Collection, row.Count, row.SumDurationMS, round(row.AvgDurationMS),
+			round(durations.Quantile(0.5)), round(durations.Quantile(0.9)), round(durations.Quantile(0.99)),
+			row.MaxDurationMS, row.DocExamined,
+		})
+	}
+
+	return result, nil
+}
+
+// groupedBy reports the total of the rollups per field.
+func groupedBy(field string) runner {
+	return func(ctx context.Context, db *mongo.Database, opts Options) (*Result, error) {
+		rollups, granularity := rollupCollection(db, opts.Since)
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: rollupFilter(opts, granularity)}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$" + field},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+				{Key: "sumDurationMS", Value: bson.D{{Key: "$sum", Value: "$sumDurationMS"}}},
+				{Key: "maxDurationMS", Value: bson.D{{Key: "$max", Value: "$maxDurationMS"}}},
+				{Key: "shapes", Value: bson.D{{Key: "$addToSet", Value: "$queryHash"}}},
+			}}},
+			{{Key: "$addFields", Value: bson.D{
+				{Key: "avgDurationMS", Value: bson.D{{Key: "$divide", Value: bson.A{"$sumDurationMS", "$count"}}}},
+				{Key: "shapes", Value: bson.D{{Key: "$size", Value: "$shapes"}}},
+			}}},
+			{{Key: "$sort", Value: bson.D{{Key: opts.Sort, Value: -1}}}},
+			{{Key: "$skip", Value: opts.Offset}},
+			{{Key: "$limit", Value: opts.Limit}},
+		}
+
+		rows := []struct {
+			ID            string  `bson:"_id"`
+			Count         int64   `bson:"count"`
+			SumDurationMS int64   `bson:"sumDurationMS"`
+			AvgDurationMS float64 `bson:"avgDurationMS"`
+			MaxDurationMS int64   `bson:"maxDurationMS"`
+			Shapes        int     `bson:"shapes"`
+		}{}
+		if err := aggregate(ctx, rollups, pipeline, &rows); err != nil {
+			return nil, err
+		}
+
+		result := &Result{Columns: []string{field, "count", "totalMS", "avgMS", "maxMS", "shapes"}}
+		for _, row := range rows {
+			result.Rows = append(result.Rows, []interface{}{row.ID, row.Count, row.SumDurationMS, round(row.AvgDurationMS), row.MaxDurationMS, row.Shapes})
+		}
+
+		return result, nil
+	}
+}
+
+// collscans reads the raw records since rollups don't keep the plan.
+func collscans(ctx context.Context, db *mongo.Database, opts Options) (*Result, error) {
+	match := recordFilter(opts)
+	match = append(match, bson.E{Key: "planSummary", Value: constant.PROFILER_COLLSCAN_PLAN_SUMMARY})
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "queryHash", Value: "$queryHash"}, {Key: "collection", Value: "$collection"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "sumDurationMS", Value: bson.D{{Key: "$sum", Value: "$durationMS"}}},
+			{Key: "docsExamined", Value: bson.D{{Key: "$sum", Value: "$docsExamined"}}},
+			{Key: "nreturned", Value: bson.D{{Key: "$sum", Value: "$nreturned"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: opts.Sort, Value: -1}}}},
+		{{Key: "$skip", Value: opts.Offset}},
+		{{Key: "$limit", Value: opts.Limit}},
+	}
+
+	rows := []struct {
+		ID struct {
+			QueryHash  string `bson:"queryHash"`
+			Collection string `bson:"collection"`
+		} `bson:"_id"`
+		Count         int64 `bson:"count"`
+		SumDurationMS int64 `bson:"sumDurationMS"`
+		DocExamined   int64 `bson:"docsExamined"`
+		NReturned     int64 `bson:"nreturned"`
+	}{}
+	if err := aggregate(ctx, db.Collection(constant.PROFILER_SLOWOPS_COLLECTION), pipeline, &rows); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: []string{"queryHash", "collection", "count", "totalMS", "docsExamined", "nreturned"}}
+	for _, row := range rows {
+		result.Rows = append(result.Rows, []interface{}{row.ID.QueryHash, row.ID.Collection, row.Count, row.SumDurationMS, row.DocExamined, row.NReturned})
+	}
+
+	return result, nil
+}
+
+// plans reads the raw records since rollups don't keep the plan.
+func plans(ctx context.Context, db *mongo.Database, opts Options) (*Result, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: recordFilter(opts)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$planSummary"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "sumDurationMS", Value: bson.D{{Key: "$sum", Value: "$durationMS"}}},
+			{Key: "docsExamined", Value: bson.D{{Key: "$sum", Value: "$docsExamined"}}},
+			{Key: "shapes", Value: bson.D{{Key: "$addToSet", Value: "$queryHash"}}},
+		}}},
+		{{Key: "$addFields", Value: bson.D{{Key: "shapes", Value: bson.D{{Key: "$size", Value: "$shapes"}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: opts.Sort, Value: -1}}}},
+		{{Key: "$skip", Value: opts.Offset}},
+		{{Key: "$limit", Value: opts.Limit}},
+	}
+
+	rows := []struct {
+		ID            string `bson:"_id"`
+		Count         int64  `bson:"count"`
+		SumDurationMS int64  `bson:"sumDurationMS"`
+		DocExamined   int64  `bson:"docsExamined"`
+		Shapes        int    `bson:"shapes"`
+	}{}
+	if err := aggregate(ctx, db.Collection(constant.PROFILER_SLOWOPS_COLLECTION), pipeline, &rows); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: []string{"planSummary", "count", "totalMS", "docsExamined", "shapes"}}
+	for _, row := range rows {
+		result.Rows = append(result.Rows, []interface{}{row.ID, row.Count, row.SumDurationMS, row.DocExamined, row.Shapes})
+	}
+
+	return result, nil
+}
+
+// examples lists the slowest records along with the shape of their query.
+func examples(ctx context.Context, db *mongo.Database, opts Options) (*Result, error) {
+	findOpts := options.Find()
+	findOpts.SetSort(bson.D{{Key: opts.Sort, Value: -1}})
+	findOpts.SetSkip(int64(opts.Offset))
+	findOpts.SetLimit(int64(opts.Limit))
+
+	cursor, err := db.Collection(constant.PROFILER_SLOWOPS_COLLECTION).Find(ctx, recordFilter(opts), findOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []collector.SlowOpsRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: []string{"timestamp", "durationMS", "collection", "user", "appName", "planSummary", "docsExamined", "nreturned", "queryHash", "shape"}}
+	for _, record := range records {
+		example := collector.SlowOpsExampleRecord{}
+		err := db.Collection(constant.PROFILER_SLOWOPS_EXAMPLE_COLLECTION).
+			FindOne(ctx, bson.M{"queryHash": record.QueryHash, "collection": record.Collection}).
+			Decode(&example)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("failed to find example of %s: %w", record.QueryHash, err)
+		}
+
+		shape := ""
+		if example.Shape != nil {
+			data, err := bson.MarshalExtJSON(example.Shape, false, false)
+			if err != nil {
+				return nil, err
+			}
+			shape = string(data)
+		}
+
+		result.Rows = append(result.Rows, []interface{}{
+			record.Timestamp.Format(time.RFC3339), record.DurationMS, record.Collection, record.User, record.AppName,
+			record.PlanSummary, record.DocExamined, record.NReturned, record.QueryHash, shape,
+		})
+	}
+
+	return result, nil
+}
+
+// rollupCollection picks the minute rollups when they still cover the start of the range, and returns the duration of
+// their buckets.
+func rollupCollection(db *mongo.Database, since time.Time) (*mongo.Collection, time.Duration) {
+	if since.After(time.Now().Add(-constant.PROFILER_ROLLUP_MINUTE_EXPIRE_SECONDS * time.Second)) {
+		return db.Collection(constant.PROFILER_ROLLUP_MINUTE_COLLECTION), time.Minute
+	}
+
+	return db.Collection(constant.PROFILER_ROLLUP_HOUR_COLLECTION), time.Hour
+}
+
+// rollupFilter includes the bucket the range starts in.
+func rollupFilter(opts Options, granularity time.Duration) bson.D {
+	return filter("bucket", opts.Since.Truncate(granularity), opts)
+}
+
+func recordFilter(opts Options) bson.D {
+	return filter("timestamp", opts.Since, opts)
+}
+
+func filter(timeField string, since time.Time, opts Options) bson.D {
+	filter := bson.D{{Key: timeField, Value: bson.D{{Key: "$gte", Value: since}, {Key: "$lt", Value: opts.Until}}}}
+	if opts.Collection != "" {
+		filter = append(filter, bson.E{Key: "collection", Value: opts.Collection})
+	}
+	if opts.User != "" {
+		filter = append(filter, bson.E{Key: "user", Value: opts.User})
+	}
+
+	return filter
+}
+
+func aggregate(ctx context.Context, collection *mongo.Collection, pipeline mongo.Pipeline, rows interface{}) error {
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+
+	return cursor.All(ctx, rows)
+}
+
+// round keeps one decimal, NaN (e.g. percentile without any value) is kept as is.
+func round(value float64) float64 {
+	if math.IsNaN(value) {
+		return value
+	}
+
+	return math.Round(value*10) / 10
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,182 @@
+package report
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/collector"
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/sketch"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Point sums up the ops of a query shape over one bucket of a time series.
+type Point struct {
+	Bucket        time.Time `json:"bucket"`
+	Count         int64     `json:"count"`
+	SumDurationMS int64     `json:"totalMS"`
+	AvgDurationMS float64   `json:"avgMS"`
+	P50DurationMS float64   `json:"p50MS"`
+	P99DurationMS float64   `json:"p99MS"`
+	MaxDurationMS int64     `json:"maxMS"`
+}
+
+// Timeseries returns the count and durations of a query shape per minute or per hour, depending on the rollups still
+// covering the start of the range. Buckets without any op are left out.
+func Timeseries(ctx context.Context, db *mongo.Database, queryHash string, opts Options) ([]Point, error) {
+	if opts.Until.IsZero() {
+		opts.Until = time.Now()
+	}
+
+	rollups, granularity := rollupCollection(db, opts.Since)
+
+	filter := rollupFilter(opts, granularity)
+	filter = append(filter, bson.E{Key: "queryHash", Value: queryHash})
+
+	cursor, err := rollups.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	points := map[time.Time]*Point{}
+	durations := map[time.Time]*sketch.Sketch{}
+	for cursor.Next(ctx) {
+		rollup := &collector.RollupRecord{}
+		if err := cursor.Decode(rollup); err != nil {
+			return nil, err
+		}
+
+		point, ok := points[rollup.Bucket]
+		if !ok {
+			point = &Point{Bucket: rollup.Bucket}
+			points[rollup.Bucket] = point
+			durations[rollup.Bucket] = sketch.New()
+		}
+
+		point.Count += rollup.Count
+		point.SumDurationMS += rollup.SumDurationMS
+		if rollup.MaxDurationMS > point.MaxDurationMS {
+			point.MaxDurationMS = rollup.MaxDurationMS
+		}
+		durations[rollup.Bucket].Merge(rollup.Durations)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	series := make([]Point, 0, len(points))
+	for bucket, point := range points {
+		point.summarize(durations[bucket])
+		series = append(series, *point)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Bucket.Before(series[j].Bucket) })
+
+	return series, nil
+}
+
+// summarize computes the average and percentiles of the bucket. NaN isn't valid JSON, so they are 0 when the bucket
+// has no duration (e.g. rollups stored with an empty sketch).
+func (point *Point) summarize(durations *sketch.Sketch) {
+	point.AvgDurationMS, point.P50DurationMS, point.P99DurationMS = 0, 0, 0
+	if point.Count > 0 {
+		point.AvgDurationMS = round(float64(point.SumDurationMS) / float64(point.Count))
+	}
+	if p50 := durations.Quantile(0.5); !math.IsNaN(p50) {
+		point.P50DurationMS = round(p50)
+	}
+	if p99 := durations.Quantile(0.99); !math.IsNaN(p99) {
+		point.P99DurationMS = round(p99)
+	}
+}
+
+// Plan is a plan used by a query shape.
+type Plan struct {
+	PlanHash      string    `json:"planHash" bson:"planHash"`
+	PlanSummary   string    `json:"planSummary" bson:"planSummary"`
+	Count         int64     `json:"count" bson:"count"`
+	AvgDurationMS float64   `json:"avgMS" bson:"avgDurationMS"`
+	DocExamined   int64     `json:"docsExamined" bson:"docsExamined"`
+	FirstSeen     time.Time `json:"firstSeen" bson:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen" bson:"lastSeen"`
+}
+
+// Plans returns the plans seen for a query shape over the range, most used first. Plans can change when indexes are
+// created or dropped, or when the plan cache is cleared.
+func Plans(ctx context.Context, db *mongo.Database, queryHash string, opts Options) ([]Plan, error) {
+	if opts.Until.IsZero() {
+		opts.Until = time.Now()
+	}
+
+	match := recordFilter(opts)
+	match = append(match, bson.E{Key: "queryHash", Value: queryHash})
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "planHash", Value: "$planHash"}, {Key: "planSummary", Value: "$planSummary"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "avgDurationMS", Value: bson.D{{Key: "$avg", Value: "$durationMS"}}},
+			{Key: "docsExamined", Value: bson.D{{Key: "$sum", Value: "$docsExamined"}}},
+			{Key: "firstSeen", Value: bson.D{{Key: "$min", Value: "$timestamp"}}},
+			{Key: "lastSeen", Value: bson.D{{Key: "$max", Value: "$timestamp"}}},
+		}}},
+		{{Key: "$addFields", Value: bson.D{
+			{Key: "planHash", Value: "$_id.planHash"},
+			{Key: "planSummary", Value: "$_id.planSummary"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+	}
+
+	plans := []Plan{}
+	if err := aggregate(ctx, db.Collection(constant.PROFILER_SLOWOPS_COLLECTION), pipeline, &plans); err != nil {
+		return nil, err
+	}
+
+	for i := range plans {
+		plans[i].AvgDurationMS = round(plans[i].AvgDurationMS)
+	}
+
+	return plans, nil
+}
+
+// Examples returns the stored examples of a query shape, one per collection unless collection is set.
+func Examples(ctx context.Context, db *mongo.Database, queryHash string, collection string) ([]collector.SlowOpsExampleRecord, error) {
+	filter := bson.D{{Key: "queryHash", Value: queryHash}}
+	if collection != "" {
+		filter = append(filter, bson.E{Key: "collection", Value: collection})
+	}
+
+	findOpts := options.Find()
+	findOpts.SetLimit(constant.REPORT_MAX_EXAMPLES)
+
+	cursor, err := db.Collection(constant.PROFILER_SLOWOPS_EXAMPLE_COLLECTION).Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	examples := []collector.SlowOpsExampleRecord{}
+	if err := cursor.All(ctx, &examples); err != nil {
+		return nil, err
+	}
+
+	return examples, nil
+}
+
+// ParseTime reads a date (2006-01-02 or RFC 3339), or a duration meaning that long ago (e.g. 24h).
+func ParseTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
@@ -0,0 +1,32 @@
+package report
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/guillotjulien/mongo-profiler/internal/sketch"
+)
+
+func TestPointSummarize(t *testing.T) {
+	t.Parallel()
+
+	empty := &Point{}
+	empty.summarize(sketch.New())
+	if _, err := json.Marshal(empty); err != nil {
+		t.Errorf("expected a bucket without durations to be valid JSON, got %v", err)
+	}
+	if empty.AvgDurationMS != 0 || empty.P50DurationMS != 0 || empty.P99DurationMS != 0 {
+		t.Errorf("expected no duration, got %+v", empty)
+	}
+
+	durations := sketch.New()
+	for _, duration := range []float64{100, 200, 300} {
+		durations.Add(duration)
+	}
+
+	point := &Point{Count: 3, SumDurationMS: 600}
+	point.summarize(durations)
+	if point.AvgDurationMS != 200 || point.P50DurationMS < 195 || point.P50DurationMS > 205 || point.P99DurationMS < point.P50DurationMS {
+		t.Errorf("unexpected durations %+v", point)
+	}
+}
@@ -0,0 +1,460 @@
+// Package shape computes query shapes from the commands recorded by the profiler.
+//
+// A query shape is the combination of query predicate, sort, projection and collation of a query
+// (https://www.mongodb.com/docs/manual/reference/glossary/#std-term-query-shape). Literal values are replaced by a
+// placeholder of their type (e.g. "?string") so that queries only differing by their parameters share the same shape.
+package shape
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/guillotjulien/mongo-profiler/internal/utils/murmur3"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const PLACEHOLDER_PREFIX = "?"
+
+// Fields of a command that carry a query predicate
+var predicateFields = map[string]bool{"filter": true, "query": true, "q": true}
+
+// Fields of a command that define the shape as is (no literal values in there)
+var keptFields = map[string]bool{
+	"sort": true, "collation": true, "hint": true, "key": true, "collection": true,
+	"upsert": true, "multi": true, "new": true, "remove": true, "upsertSupplied": true,
+}
+
+// Fields of a command whose value is a parameter of the query
+var parameterFields = map[string]bool{"limit": true, "skip": true, "let": true, "min": true, "max": true}
+
+// Pipeline stages that don't hold literal values
+var keptStages = map[string]bool{
+	"$sort": true, "$unwind": true, "$count": true, "$out": true, "$merge": true, "$unset": true,
+	"$collStats": true, "$indexStats": true, "$planCacheStats": true,
+}
+
+// Fields of $lookup, $unionWith and $graphLookup naming collections and fields (no literal values in there)
+var joinFields = map[string]bool{
+	"from": true, "coll": true, "localField": true, "foreignField": true, "as": true,
+	"connectFromField": true, "connectToField": true, "depthField": true,
+}
+
+// Of returns the shape of a command run against the ns namespace.
+func Of(ns string, command bson.Raw) bson.D {
+	return append(bson.D{{Key: "ns", Value: ns}}, Command(command)...)
+}
+
+// Hash identifies a shape with the same format as the server queryHash (e.g. FFF0C0D3).
+func Hash(shape bson.D) string {
+	data, err := bson.Marshal(shape)
+	if err != nil {
+		return ""
+	}
+
+	h1, _ := murmur3.Hash(data, 0)
+
+	return fmt.Sprintf("%08X", uint32(h1))
+}
+
+// Command keeps the fields of the command defining the shape of the query and normalizes them. Everything else
+// (batchSize, lsid, $db, readConcern...) is dropped.
+func Command(command bson.Raw) bson.D {
+	shape := bson.D{}
+
+	elements, err := command.Elements()
+	if err != nil {
+		return shape
+	}
+
+	for i, el := range elements {
+		key, val := el.Key(), el.Value()
+
+		switch {
+		case predicateFields[key]:
+			shape = append(shape, bson.E{Key: key, Value: Predicate(val)})
+		case key == "pipeline":
+			shape = append(shape, bson.E{Key: key, Value: Pipeline(val)})
+		case key == "u" || key == "update":
+			shape = append(shape, bson.E{Key: key, Value: update(val)})
+		case key == "projection" || key == "fields":
+			shape = append(shape, bson.E{Key: key, Value: projection(val)})
+		case keptFields[key]:
+			shape = append(shape, bson.E{Key: key, Value: val})
+		case parameterFields[key]:
+			shape = append(shape, bson.E{Key: key, Value: Placeholder(val)})
+		case key == "$truncated": // Command too large for the profiler, serialized as a string holding every literal
+			shape = append(shape, bson.E{Key: key, Value: Placeholder(val)})
+		case i == 0 && !strings.HasPrefix(key, "$"): // Command name, e.g. find: "collection"
+			if val.Type == bsontype.String {
+				shape = append(shape, bson.E{Key: key, Value: val})
+			} else {
+				shape = append(shape, bson.E{Key: key, Value: Placeholder(val)}) // e.g. aggregate: 1, getMore: <cursorid>
+			}
+		}
+	}
+
+	return shape
+}
+
+// Predicate normalizes a query predicate. Field order is canonicalized since conditions are implicitly ANDed.
+func Predicate(val bson.RawValue) interface{} {
+	doc, ok := val.DocumentOK()
+	if !ok {
+		return Placeholder(val)
+	}
+
+	return predicateDocument(doc)
+}
+
+func predicateDocument(doc bson.Raw) bson.D {
+	shape := bson.D{}
+
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		key, val := el.Key(), el.Value()
+
+		if strings.HasPrefix(key, "$") {
+			shape = append(shape, bson.E{Key: key, Value: operator(key, val)})
+		} else {
+			shape = append(shape, bson.E{Key: key, Value: condition(val)})
+		}
+	}
+
+	sortKeys(shape)
+
+	return shape
+}
+
+// condition normalizes the value matched against a field: either operators ({$gt: 1}) or a literal (equality).
+func condition(val bson.RawValue) interface{} {
+	doc, ok := val.DocumentOK()
+	if !ok || !isOperatorDocument(doc) {
+		return Placeholder(val)
+	}
+
+	shape := bson.D{}
+
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		shape = append(shape, bson.E{Key: el.Key(), Value: operator(el.Key(), el.Value())})
+	}
+
+	sortKeys(shape)
+
+	return shape
+}
+
+func operator(op string, val bson.RawValue) interface{} {
+	switch op {
+	case "$and", "$or", "$nor":
+		return clauses(val)
+	case "$elemMatch":
+		if doc, ok := val.DocumentOK(); ok && !isOperatorDocument(doc) {
+			return predicateDocument(doc)
+		}
+		return condition(val)
+	case "$not":
+		return condition(val)
+	case "$expr":
+		return Expression(val)
+	case "$exists", "$type":
+		return val // Changes the meaning of the query, not a parameter
+	case "$in", "$nin", "$all":
+		return Placeholder(val) // Number of values doesn't change the shape
+	}
+
+	return literal(val)
+}
+
+// clauses normalizes $and / $or / $nor. Clauses are sorted since their order doesn't change the result.
+func clauses(val bson.RawValue) interface{} {
+	arr, ok := val.ArrayOK()
+	if !ok {
+		return Placeholder(val)
+	}
+
+	values, _ := arr.Values()
+
+	shape := bson.A{}
+	for _, v := range values {
+		shape = append(shape, Predicate(v))
+	}
+
+	sort.SliceStable(shape, func(i, j int) bool {
+		return bytes.Compare(marshalValue(shape[i]), marshalValue(shape[j])) < 0
+	})
+
+	return shape
+}
+
+// Pipeline normalizes the stages of an aggregation pipeline. Stage order matters so it is kept.
+func Pipeline(val bson.RawValue) interface{} {
+	arr, ok := val.ArrayOK()
+	if !ok {
+		return Placeholder(val)
+	}
+
+	values, _ := arr.Values()
+
+	shape := bson.A{}
+	for _, v := range values {
+		stage, ok := v.DocumentOK()
+		if !ok {
+			shape = append(shape, Placeholder(v))
+			continue
+		}
+
+		elements, _ := stage.Elements()
+		if len(elements) == 0 {
+			continue
+		}
+
+		name, spec := elements[0].Key(), elements[0].Value()
+		shape = append(shape, bson.D{{Key: name, Value: Stage(name, spec)}})
+	}
+
+	return shape
+}
+
+// Stage normalizes the specification of a single pipeline stage.
+func Stage(name string, spec bson.RawValue) interface{} {
+	switch name {
+	case "$match":
+		return Predicate(spec)
+	case "$limit", "$skip", "$sample":
+		return literal(spec)
+	case "$lookup", "$unionWith", "$graphLookup":
+		doc, ok := spec.DocumentOK()
+		if !ok {
+			return spec // e.g. $unionWith: "collection"
+		}
+
+		shape := bson.D{}
+		elements, _ := doc.Elements()
+		for _, el := range elements {
+			key, val := el.Key(), el.Value()
+
+			switch {
+			case key == "pipeline":
+				shape = append(shape, bson.E{Key: key, Value: Pipeline(val)})
+			case key == "let" || key == "startWith":
+				shape = append(shape, bson.E{Key: key, Value: Expression(val)})
+			case key == "restrictSearchWithMatch":
+				shape = append(shape, bson.E{Key: key, Value: Predicate(val)})
+			case joinFields[key]:
+				shape = append(shape, bson.E{Key: key, Value: val})
+			default:
+				shape = append(shape, bson.E{Key: key, Value: Placeholder(val)}) // e.g. maxDepth
+			}
+		}
+		return shape
+	case "$facet":
+		doc, ok := spec.DocumentOK()
+		if !ok {
+			return Placeholder(spec)
+		}
+
+		shape := bson.D{}
+		elements, _ := doc.Elements()
+		for _, el := range elements {
+			shape = append(shape, bson.E{Key: el.Key(), Value: Pipeline(el.Value())})
+		}
+		return shape
+	}
+
+	if keptStages[name] {
+		return spec
+	}
+
+	return Expression(spec) // $group, $project, $addFields, $replaceRoot...
+}
+
+// Expression normalizes an aggregation expression: field paths and variables ("$field", "$$ROOT") are kept, any
+// other literal is replaced by a placeholder.
+func Expression(val bson.RawValue) interface{} {
+	switch val.Type {
+	case bsontype.String:
+		if strings.HasPrefix(val.StringValue(), "$") {
+			return val
+		}
+	case bsontype.EmbeddedDocument:
+		shape := bson.D{}
+		elements, _ := val.Document().Elements()
+		for _, el := range elements {
+			if el.Key() == "$literal" {
+				shape = append(shape, bson.E{Key: el.Key(), Value: Placeholder(el.Value())})
+			} else {
+				shape = append(shape, bson.E{Key: el.Key(), Value: Expression(el.Value())})
+			}
+		}
+		return shape
+	case bsontype.Array: // Operator arguments, position matters
+		shape := bson.A{}
+		values, _ := val.Array().Values()
+		for _, v := range values {
+			shape = append(shape, Expression(v))
+		}
+		return shape
+	}
+
+	return Placeholder(val)
+}
+
+// update normalizes the update part of an update / findAndModify: operators and updated fields are kept,
+// replacement documents are a literal and pipeline updates are normalized like any pipeline.
+func update(val bson.RawValue) interface{} {
+	if val.Type == bsontype.Array {
+		return Pipeline(val)
+	}
+
+	doc, ok := val.DocumentOK()
+	if !ok || !isOperatorDocument(doc) {
+		return Placeholder(val)
+	}
+
+	shape := bson.D{}
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		fields, ok := el.Value().DocumentOK()
+		if !ok {
+			shape = append(shape, bson.E{Key: el.Key(), Value: Placeholder(el.Value())})
+			continue
+		}
+
+		updated := bson.D{}
+		fieldElements, _ := fields.Elements()
+		for _, field := range fieldElements {
+			updated = append(updated, bson.E{Key: field.Key(), Value: literal(field.Value())})
+		}
+		sortKeys(updated)
+
+		shape = append(shape, bson.E{Key: el.Key(), Value: updated})
+	}
+
+	sortKeys(shape)
+
+	return shape
+}
+
+// projection sorts the projected fields (they are returned in the document order anyway). Values are kept since
+// they define what is returned, except for the arguments of operators.
+func projection(val bson.RawValue) interface{} {
+	doc, ok := val.DocumentOK()
+	if !ok {
+		return Placeholder(val)
+	}
+
+	shape := bson.D{}
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		shape = append(shape, bson.E{Key: el.Key(), Value: projected(el.Value())})
+	}
+
+	sortKeys(shape)
+
+	return shape
+}
+
+// projected normalizes the value of a projected field: inclusion flags, $meta and nested projections are kept,
+// $elemMatch is normalized like a query, $slice arguments and expressions (MongoDB 4.4+) hold literals.
+func projected(val bson.RawValue) interface{} {
+	doc, ok := val.DocumentOK()
+	if !ok {
+		if val.Type == bsontype.String {
+			return Expression(val)
+		}
+		return val // 1, 0, true or false
+	}
+
+	shape := bson.D{}
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		key, v := el.Key(), el.Value()
+
+		switch {
+		case key == "$elemMatch":
+			shape = append(shape, bson.E{Key: key, Value: operator(key, v)})
+		case key == "$slice":
+			shape = append(shape, bson.E{Key: key, Value: Placeholder(v)})
+		case key == "$meta":
+			shape = append(shape, bson.E{Key: key, Value: v})
+		case strings.HasPrefix(key, "$"):
+			shape = append(shape, bson.E{Key: key, Value: Expression(v)})
+		default:
+			shape = append(shape, bson.E{Key: key, Value: projected(v)})
+		}
+	}
+
+	return shape
+}
+
+// literal replaces every scalar by a placeholder, keeping the structure of documents (e.g. GeoJSON, $text).
+func literal(val bson.RawValue) interface{} {
+	doc, ok := val.DocumentOK()
+	if !ok {
+		return Placeholder(val)
+	}
+
+	shape := bson.D{}
+	elements, _ := doc.Elements()
+	for _, el := range elements {
+		shape = append(shape, bson.E{Key: el.Key(), Value: literal(el.Value())})
+	}
+
+	return shape
+}
+
+// Placeholder replaces a literal value by its type, e.g. "?string". All numeric types share the same placeholder
+// since the server compares them by value.
+func Placeholder(val bson.RawValue) string {
+	switch val.Type {
+	case bsontype.Double, bsontype.Int32, bsontype.Int64, bsontype.Decimal128:
+		return PLACEHOLDER_PREFIX + "number"
+	case bsontype.EmbeddedDocument:
+		return PLACEHOLDER_PREFIX + "object"
+	case bsontype.Array:
+		return PLACEHOLDER_PREFIX + "array"
+	case bsontype.Boolean:
+		return PLACEHOLDER_PREFIX + "bool"
+	case bsontype.ObjectID:
+		return PLACEHOLDER_PREFIX + "objectId"
+	case bsontype.DateTime:
+		return PLACEHOLDER_PREFIX + "date"
+	case bsontype.Binary:
+		return PLACEHOLDER_PREFIX + "binData"
+	case bsontype.Regex:
+		return PLACEHOLDER_PREFIX + "regex"
+	}
+
+	return PLACEHOLDER_PREFIX + val.Type.String()
+}
+
+func isOperatorDocument(doc bson.Raw) bool {
+	elements, err := doc.Elements()
+	if err != nil || len(elements) == 0 {
+		return false
+	}
+
+	for _, el := range elements {
+		if !strings.HasPrefix(el.Key(), "$") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortKeys(d bson.D) {
+	sort.SliceStable(d, func(i, j int) bool {
+		return d[i].Key < d[j].Key
+	})
+}
+
+func marshalValue(v interface{}) []byte {
+	_, data, _ := bson.MarshalValue(v)
+	return data
+}
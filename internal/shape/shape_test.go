@@ -0,0 +1,194 @@
+package shape
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func raw(t *testing.T, extJSON string) bson.Raw {
+	t.Helper()
+
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(extJSON), false, &doc); err != nil {
+		t.Fatalf("invalid test document %s: %v", extJSON, err)
+	}
+	return doc
+}
+
+func TestSameShape(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{
+			"different literals",
+			`{"find": "users", "filter": {"email": "a@b.c", "age": {"$gt": 18}}, "$db": "app", "lsid": {"id": 1}}`,
+			`{"find": "users", "filter": {"email": "x@y.z", "age": {"$gt": 42}}, "batchSize": 10}`,
+		},
+		{
+			"field order",
+			`{"find": "users", "filter": {"email": "a@b.c", "age": {"$gt": 18, "$lt": 30}}}`,
+			`{"find": "users", "filter": {"age": {"$lt": 1, "$gt": 2}, "email": "x@y.z"}}`,
+		},
+		{
+			"numeric types",
+			`{"find": "users", "filter": {"age": 1}}`,
+			`{"find": "users", "filter": {"age": 1.5}}`,
+		},
+		{
+			"$in length",
+			`{"find": "users", "filter": {"status": {"$in": ["a"]}}}`,
+			`{"find": "users", "filter": {"status": {"$in": ["a", "b", "c"]}}}`,
+		},
+		{
+			"$or clause order",
+			`{"find": "users", "filter": {"$or": [{"a": 1}, {"b": "x"}]}}`,
+			`{"find": "users", "filter": {"$or": [{"b": "y"}, {"a": 2}]}}`,
+		},
+		{
+			"pipeline literals",
+			`{"aggregate": "orders", "pipeline": [{"$match": {"status": "paid"}}, {"$group": {"_id": "$user", "total": {"$sum": "$amount"}}}, {"$limit": 10}], "cursor": {}}`,
+			`{"aggregate": "orders", "pipeline": [{"$match": {"status": "new"}}, {"$group": {"_id": "$user", "total": {"$sum": "$amount"}}}, {"$limit": 5}], "cursor": {"batchSize": 2}}`,
+		},
+		{
+			"truncated commands",
+			`{"$truncated": "{ find: \"users\", filter: { email: \"a@b.c\" } }", "comment": "export"}`,
+			`{"$truncated": "{ find: \"users\", filter: { email: \"x@y.z\" } }", "comment": "export"}`,
+		},
+		{
+			"projection operator arguments",
+			`{"find": "users", "projection": {"orders": {"$elemMatch": {"sku": "A1"}}, "tags": {"$slice": [0, 5]}, "name": 1}}`,
+			`{"find": "users", "projection": {"name": 1, "tags": {"$slice": [10, 5]}, "orders": {"$elemMatch": {"sku": "B2"}}}}`,
+		},
+		{
+			"update values",
+			`{"q": {"_id": {"$oid": "62a0b0f0f0f0f0f0f0f0f0f0"}}, "u": {"$set": {"name": "a", "age": 1}}, "multi": false}`,
+			`{"q": {"_id": {"$oid": "62a0b0f0f0f0f0f0f0f0f0f1"}}, "u": {"$set": {"age": 2, "name": "b"}}, "multi": false}`,
+		},
+	}
+
+	for _, test := range tests {
+		a, b := Of("app.c", raw(t, test.a)), Of("app.c", raw(t, test.b))
+		if Hash(a) != Hash(b) {
+			t.Errorf("%s: expected same shape, got %v and %v", test.name, a, b)
+		}
+	}
+}
+
+func TestDifferentShape(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{
+			"different fields",
+			`{"find": "users", "filter": {"email": "a@b.c"}}`,
+			`{"find": "users", "filter": {"name": "a@b.c"}}`,
+		},
+		{
+			"different operator",
+			`{"find": "users", "filter": {"age": {"$gt": 1}}}`,
+			`{"find": "users", "filter": {"age": {"$lt": 1}}}`,
+		},
+		{
+			"different sort",
+			`{"find": "users", "filter": {"age": 1}, "sort": {"age": 1}}`,
+			`{"find": "users", "filter": {"age": 1}, "sort": {"age": -1}}`,
+		},
+		{
+			"sort order",
+			`{"find": "users", "sort": {"a": 1, "b": 1}}`,
+			`{"find": "users", "sort": {"b": 1, "a": 1}}`,
+		},
+		{
+			"stage order",
+			`{"aggregate": "orders", "pipeline": [{"$match": {"a": 1}}, {"$sort": {"a": 1}}]}`,
+			`{"aggregate": "orders", "pipeline": [{"$sort": {"a": 1}}, {"$match": {"a": 1}}]}`,
+		},
+		{
+			"$exists value",
+			`{"find": "users", "filter": {"deletedAt": {"$exists": true}}}`,
+			`{"find": "users", "filter": {"deletedAt": {"$exists": false}}}`,
+		},
+		{
+			"literal type",
+			`{"find": "users", "filter": {"_id": "abc"}}`,
+			`{"find": "users", "filter": {"_id": {"$oid": "62a0b0f0f0f0f0f0f0f0f0f0"}}}`,
+		},
+	}
+
+	for _, test := range tests {
+		a, b := Of("app.c", raw(t, test.a)), Of("app.c", raw(t, test.b))
+		if Hash(a) == Hash(b) {
+			t.Errorf("%s: expected different shapes, got %v for both", test.name, a)
+		}
+	}
+}
+
+func TestLiteralsAreReplaced(t *testing.T) {
+	t.Parallel()
+
+	shape := Of("app.users", raw(t, `{"find": "users", "filter": {"email": "secret@example.com", "$expr": {"$eq": ["$a", "secret"]}}}`))
+
+	data, err := bson.MarshalExtJSON(shape, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"ns":"app.users","find":"users","filter":{"$expr":{"$eq":["$a","?string"]},"email":"?string"}}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestJoinLiteralsAreReplaced(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		command  string
+		expected string
+	}{
+		{
+			`{"aggregate": "users", "pipeline": [{"$graphLookup": {"from": "users", "startWith": {"$concat": ["$manager", "secret"]}, "connectFromField": "manager", "connectToField": "_id", "as": "chain", "maxDepth": 3, "restrictSearchWithMatch": {"email": "secret@example.com"}}}]}`,
+			`{"ns":"app.users","aggregate":"users","pipeline":[{"$graphLookup":{"from":"users","startWith":{"$concat":["$manager","?string"]},"connectFromField":"manager","connectToField":"_id","as":"chain","maxDepth":"?number","restrictSearchWithMatch":{"email":"?string"}}}]}`,
+		},
+		{
+			`{"aggregate": "users", "pipeline": [{"$graphLookup": {"from": "users", "startWith": "secret", "connectFromField": "manager", "connectToField": "_id", "as": "chain"}}]}`,
+			`{"ns":"app.users","aggregate":"users","pipeline":[{"$graphLookup":{"from":"users","startWith":"?string","connectFromField":"manager","connectToField":"_id","as":"chain"}}]}`,
+		},
+		{
+			`{"aggregate": "users", "pipeline": [{"$lookup": {"from": "orders", "localField": "_id", "foreignField": "user", "as": "orders", "unknown": "secret"}}]}`,
+			`{"ns":"app.users","aggregate":"users","pipeline":[{"$lookup":{"from":"orders","localField":"_id","foreignField":"user","as":"orders","unknown":"?string"}}]}`,
+		},
+	} {
+		data, err := bson.MarshalExtJSON(Of("app.users", raw(t, test.command)), false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, data)
+		}
+	}
+}
+
+func TestTruncatedCommandIsReplaced(t *testing.T) {
+	t.Parallel()
+
+	shape := Of("app.users", raw(t, `{"$truncated": "{ find: \"users\", filter: { email: \"secret@example.com\" } }"}`))
+
+	data, err := bson.MarshalExtJSON(shape, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"ns":"app.users","$truncated":"?string"}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
@@ -0,0 +1,150 @@
+// Package sketch implements a mergeable quantile sketch (DDSketch, https://arxiv.org/abs/1908.10693) used to compute
+// percentiles of durations without keeping every value.
+//
+// Values are counted in logarithmic bins: bin 0 holds the values <= 0, bin 1 the values in (0, 1] and bin i the values
+// in (γ^(i-2), γ^(i-1)], with γ = (1+α)/(1-α). Any quantile of values >= 1 (e.g. durations in ms) is then known within
+// a relative error α. Bins are the same for every sketch, so merging sketches is just summing their bins, which MongoDB
+// can do with $inc on the stored document.
+package sketch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var gamma = (1 + constant.PROFILER_SKETCH_RELATIVE_ACCURACY) / (1 - constant.PROFILER_SKETCH_RELATIVE_ACCURACY)
+
+// Sketch is stored in BSON as a document mapping each bin to its count, e.g. {"0": 2, "233": 10}.
+type Sketch struct {
+	bins  map[int]int64
+	count int64
+}
+
+func New() *Sketch {
+	return &Sketch{bins: map[int]int64{}}
+}
+
+// Bin returns the bin of value.
+func Bin(value float64) int {
+	if value <= 0 {
+		return 0
+	}
+	if value <= 1 { // Would get bins <= 0 otherwise
+		return 1
+	}
+
+	return int(math.Ceil(math.Log(value)/math.Log(gamma))) + 1
+}
+
+// Add counts value once.
+func (s *Sketch) Add(value float64) {
+	s.AddN(value, 1)
+}
+
+// AddN counts value n times.
+func (s *Sketch) AddN(value float64, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	s.bins[Bin(value)] += n
+	s.count += n
+}
+
+// Merge adds every value of other to the sketch.
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil {
+		return
+	}
+
+	for bin, n := range other.bins {
+		s.bins[bin] += n
+	}
+	s.count += other.count
+}
+
+func (s *Sketch) Count() int64 {
+	return s.count
+}
+
+// Quantile returns an estimate of the q-quantile (0 <= q <= 1), e.g. Quantile(0.99) for p99. Returns NaN when the
+// sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+
+	bins := make([]int, 0, len(s.bins))
+	for bin := range s.bins {
+		bins = append(bins, bin)
+	}
+	sort.Ints(bins)
+
+	rank := q * float64(s.count-1)
+
+	var seen int64
+	for _, bin := range bins {
+		seen += s.bins[bin]
+		if float64(seen) > rank {
+			return value(bin)
+		}
+	}
+
+	return value(bins[len(bins)-1])
+}
+
+// Bins returns the count of each bin, keyed like in the stored document (e.g. to $inc them).
+func (s *Sketch) Bins() map[string]int64 {
+	bins := make(map[string]int64, len(s.bins))
+	for bin, n := range s.bins {
+		bins[strconv.Itoa(bin)] = n
+	}
+
+	return bins
+}
+
+func (s *Sketch) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(s.Bins())
+}
+
+func (s *Sketch) UnmarshalBSON(data []byte) error {
+	elements, err := bson.Raw(data).Elements()
+	if err != nil {
+		return err
+	}
+
+	s.bins = make(map[int]int64, len(elements))
+	s.count = 0
+
+	for _, element := range elements {
+		bin, err := strconv.Atoi(element.Key())
+		if err != nil {
+			return fmt.Errorf("invalid sketch bin %q: %w", element.Key(), err)
+		}
+
+		n, ok := element.Value().AsInt64OK()
+		if !ok {
+			return fmt.Errorf("invalid count for sketch bin %q: %v", element.Key(), element.Value())
+		}
+
+		s.bins[bin] += n
+		s.count += n
+	}
+
+	return nil
+}
+
+// value is the estimate of the values of a bin, within a relative error α of any of them.
+func value(bin int) float64 {
+	if bin == 0 {
+		return 0
+	}
+
+	return 2 * math.Pow(gamma, float64(bin-1)) / (gamma + 1)
+}
@@ -0,0 +1,117 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestQuantile(t *testing.T) {
+	t.Parallel()
+
+	random := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	s := New()
+	for i := range values {
+		values[i] = math.Floor(math.Exp(random.NormFloat64()*1.5 + 5)) // Long tail of durations in ms
+		s.Add(values[i])
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.5, 0.85, 0.9, 0.99, 1} {
+		expected := values[int(q*float64(len(values)-1))]
+		actual := s.Quantile(q)
+		if math.Abs(actual-expected) > expected*constant.PROFILER_SKETCH_RELATIVE_ACCURACY {
+			t.Errorf("p%v: expected %v within %v%%, got %v", q*100, expected, constant.PROFILER_SKETCH_RELATIVE_ACCURACY*100, actual)
+		}
+	}
+
+	if !math.IsNaN(New().Quantile(0.5)) {
+		t.Error("quantile of an empty sketch should be NaN")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	a, b, all := New(), New(), New()
+	for i := 0; i < 1000; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i * 10))
+		all.Add(float64(i))
+		all.Add(float64(i * 10))
+	}
+
+	a.Merge(b)
+
+	if a.Count() != all.Count() {
+		t.Fatalf("expected %v values, got %v", all.Count(), a.Count())
+	}
+	for _, q := range []float64{0.1, 0.5, 0.99} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("p%v: merged sketch gives %v, expected %v", q*100, a.Quantile(q), all.Quantile(q))
+		}
+	}
+}
+
+func TestBSON(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.Add(0)
+	s.AddN(120, 3)
+	s.Add(4000)
+
+	data, err := bson.Marshal(bson.M{"durations": s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := struct {
+		Durations *Sketch `bson:"durations"`
+	}{}
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Durations.Count() != 5 || decoded.Durations.Quantile(0.5) != s.Quantile(0.5) {
+		t.Errorf("sketch changed through BSON: %v", decoded.Durations.Bins())
+	}
+	if Bin(0) != 0 || Bin(1) != 1 || Bin(100) != Bin(101) || Bin(100) >= Bin(103) {
+		t.Error("unexpected bins")
+	}
+}
+
+func TestBin(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		value float64
+		bin   int
+	}{
+		{-1, 0},
+		{0, 0},
+		{0.0001, 1},
+		{0.5, 1},
+		{1 / gamma, 1},
+		{1, 1},
+		{1.01, 2},
+	} {
+		if bin := Bin(tc.value); bin != tc.bin {
+			t.Errorf("expected %v in bin %v, got %v", tc.value, tc.bin, bin)
+		}
+	}
+
+	for value := 1.5; value < 1e6; value *= 1.7 {
+		s := New()
+		s.Add(value)
+		if actual := s.Quantile(0.5); math.Abs(actual-value) > value*constant.PROFILER_SKETCH_RELATIVE_ACCURACY {
+			t.Errorf("expected %v within %v%%, got %v", value, constant.PROFILER_SKETCH_RELATIVE_ACCURACY*100, actual)
+		}
+	}
+}
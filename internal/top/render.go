@@ -0,0 +1,125 @@
+package top
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	clearScreen = "\x1b[H\x1b[2J"
+	reverse     = "\x1b[7m"
+	bold        = "\x1b[1m"
+	reset       = "\x1b[0m"
+)
+
+// View is what the screen shows: the rows of a grouping, or the latest entry of the selected row.
+type View struct {
+	Grouping Grouping
+	Selected int
+	Detail   bool
+	Height   int
+	Width    int
+	Status   string // e.g. the last error
+}
+
+// Render draws the whole screen, rows are cut to fit the terminal.
+func Render(w io.Writer, view View, rows []Row, span time.Duration, now time.Time) {
+	lines := []string{
+		fmt.Sprintf("%smongo-profiler top%s - %s - last %s grouped by %s", bold, reset, now.Format("15:04:05"), span, view.Grouping),
+		"[s]hape [c]ollection [u]ser [h]ost, [j/k] select, [enter] details, [q]uit",
+		"",
+	}
+
+	if view.Detail && view.Selected < len(rows) {
+		lines = append(lines, detail(rows[view.Selected])...)
+	} else {
+		lines = append(lines, fit(fmt.Sprintf("%-4s %-48s %8s %10s %9s %9s  %s", "#", strings.ToUpper(string(view.Grouping)), "COUNT", "TOTAL MS", "AVG MS", "MAX MS", "PLAN"), view.Width))
+		for i, row := range rows {
+			line := fit(fmt.Sprintf("%-4d %-48s %8d %10d %9.1f %9d  %s", i+1, cut(row.Key, 48), row.Count, row.TotalMS, row.AvgMS(), row.MaxMS, row.Latest.PlanSummary), view.Width)
+			if i == view.Selected {
+				line = reverse + line + reset
+			}
+			lines = append(lines, line)
+		}
+		if len(rows) == 0 {
+			lines = append(lines, "no slow operation yet")
+		}
+	}
+
+	if view.Height > 1 && len(lines) > view.Height-1 {
+		lines = lines[:view.Height-1]
+	}
+	if view.Status != "" {
+		lines = append(lines, fit(view.Status, view.Width))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(clearScreen)
+	buf.WriteString(strings.Join(lines, "\n"))
+	w.Write(buf.Bytes()) // Single write to avoid flickering
+}
+
+// detail shows the latest entry of the row.
+func detail(row Row) []string {
+	entry := row.Latest
+
+	lines := []string{
+		fmt.Sprintf("%s%s%s", bold, row.Key, reset),
+		fmt.Sprintf("%v ops, %vms total, %.1fms avg, %vms max", row.Count, row.TotalMS, row.AvgMS(), row.MaxMS),
+		"",
+		"Latest operation:",
+		fmt.Sprintf("  time:     %s", entry.Timestamp.Format(time.RFC3339)),
+		fmt.Sprintf("  op:       %s %s", entry.OP, entry.Collection),
+		fmt.Sprintf("  duration: %vms", entry.DurationMS),
+		fmt.Sprintf("  host:     %s", entry.Host),
+		fmt.Sprintf("  user:     %s %s", entry.User, entry.AppName),
+		fmt.Sprintf("  plan:     %s", entry.PlanSummary),
+		fmt.Sprintf("  examined: %v keys, %v docs, returned %v", entry.KeysExamined, entry.DocExamined, entry.NReturned),
+		"",
+		"Shape:",
+	}
+	lines = append(lines, indented(entry.Shape)...)
+
+	if command, ok := entry.Document.Lookup("command").DocumentOK(); ok {
+		lines = append(lines, "", "Command:")
+		lines = append(lines, indented(command)...)
+	}
+
+	return append(lines, "", "[esc] back")
+}
+
+func indented(document interface{}) []string {
+	data, err := bson.MarshalExtJSON(document, false, false)
+	if err != nil {
+		return []string{fmt.Sprintf("  %v", err)}
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "  ", "  "); err != nil {
+		return []string{"  " + string(data)}
+	}
+
+	return strings.Split("  "+buf.String(), "\n")
+}
+
+func cut(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+
+	return s[:width-1] + "~"
+}
+
+func fit(line string, width int) string {
+	if width <= 0 {
+		return line
+	}
+
+	return cut(line, width)
+}
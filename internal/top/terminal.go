@@ -0,0 +1,133 @@
+package top
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type Key int
+
+const (
+	KEY_NONE Key = iota
+	KEY_UP
+	KEY_DOWN
+	KEY_ENTER
+	KEY_ESCAPE
+	KEY_QUIT
+	KEY_SHAPE
+	KEY_COLLECTION
+	KEY_USER
+	KEY_HOST
+)
+
+// Terminal switches the terminal to unbuffered input without echo, relying on stty so that we don't need a terminal
+// library. Ctrl+C still sends SIGINT.
+type Terminal struct {
+	state string // As saved by stty -g, restored on Close
+}
+
+func OpenTerminal() (*Terminal, error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terminal state (is stdin a terminal?): %w", err)
+	}
+
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil, fmt.Errorf("failed to set terminal mode: %w", err)
+	}
+
+	fmt.Print("\x1b[?25l") // Hide cursor
+
+	return &Terminal{state: strings.TrimSpace(state)}, nil
+}
+
+func (t *Terminal) Close() error {
+	fmt.Print("\x1b[?25h\x1b[H\x1b[2J") // Show cursor, clear screen
+
+	_, err := stty(t.state)
+	return err
+}
+
+// Size returns the number of rows and columns, 24x80 when unknown.
+func (t *Terminal) Size() (int, int) {
+	out, err := stty("size")
+	if err != nil {
+		return 24, 80
+	}
+
+	var rows, columns int
+	if _, err := fmt.Sscan(out, &rows, &columns); err != nil || rows == 0 {
+		return 24, 80
+	}
+
+	return rows, columns
+}
+
+// ReadKeys sends the keys pressed to keys until r is closed.
+func ReadKeys(r io.Reader, keys chan<- Key) {
+	defer close(keys)
+
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, key := range parseKeys(buf[:n]) {
+			keys <- key
+		}
+	}
+}
+
+func parseKeys(input []byte) []Key {
+	keys := []Key{}
+
+	for i := 0; i < len(input); i++ {
+		switch input[i] {
+		case 0x1b:
+			if i+2 < len(input) && input[i+1] == '[' { // Arrow keys
+				switch input[i+2] {
+				case 'A':
+					keys = append(keys, KEY_UP)
+				case 'B':
+					keys = append(keys, KEY_DOWN)
+				}
+				i += 2
+				continue
+			}
+			keys = append(keys, KEY_ESCAPE)
+		case 'k':
+			keys = append(keys, KEY_UP)
+		case 'j':
+			keys = append(keys, KEY_DOWN)
+		case '\r', '\n', 'd':
+			keys = append(keys, KEY_ENTER)
+		case 0x7f, 'b':
+			keys = append(keys, KEY_ESCAPE)
+		case 'q', 'Q':
+			keys = append(keys, KEY_QUIT)
+		case 's':
+			keys = append(keys, KEY_SHAPE)
+		case 'c':
+			keys = append(keys, KEY_COLLECTION)
+		case 'u':
+			keys = append(keys, KEY_USER)
+		case 'h':
+			keys = append(keys, KEY_HOST)
+		}
+	}
+
+	return keys
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,132 @@
+// Package top aggregates the live stream of profile entries for the top command.
+package top
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/collector"
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+)
+
+type Grouping string
+
+const (
+	GROUP_SHAPE      Grouping = "shape"
+	GROUP_COLLECTION Grouping = "collection"
+	GROUP_USER       Grouping = "user"
+	GROUP_HOST       Grouping = "host"
+)
+
+// Row sums up the entries of a group over the window.
+type Row struct {
+	Key     string
+	Count   int
+	TotalMS int64
+	MaxMS   int
+	Latest  *collector.ProfilerEntry // Most recent entry of the group, shown when drilling down
+}
+
+func (r Row) AvgMS() float64 {
+	return float64(r.TotalMS) / float64(r.Count)
+}
+
+// Window keeps the entries of the last span, up to TOP_MAX_ENTRIES (oldest entries are dropped first).
+type Window struct {
+	span time.Duration
+
+	lock    sync.Mutex
+	entries []*item
+}
+
+type item struct {
+	entry     *collector.ProfilerEntry
+	queryHash string // Same as the one stored by the collector
+}
+
+func NewWindow(span time.Duration) *Window {
+	w := &Window{}
+	w.span = span
+
+	return w
+}
+
+func (w *Window) Span() time.Duration {
+	return w.span
+}
+
+func (w *Window) Add(entry *collector.ProfilerEntry) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.entries = append(w.entries, &item{entry: entry, queryHash: entry.StoredQueryHash()})
+	if len(w.entries) > constant.TOP_MAX_ENTRIES {
+		w.entries = w.entries[len(w.entries)-constant.TOP_MAX_ENTRIES:]
+	}
+}
+
+// Rows forgets the entries older than the span and groups the other ones, most total time first.
+func (w *Window) Rows(grouping Grouping, now time.Time) []Row {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	since := now.Add(-w.span)
+
+	kept := w.entries[:0]
+	rows := map[string]*Row{}
+	for _, item := range w.entries {
+		if item.entry.Timestamp.Before(since) {
+			continue
+		}
+		kept = append(kept, item)
+
+		entry := item.entry
+		key := groupKey(grouping, item)
+		row, ok := rows[key]
+		if !ok {
+			row = &Row{Key: key}
+			rows[key] = row
+		}
+
+		row.Count++
+		row.TotalMS += int64(entry.DurationMS)
+		if entry.DurationMS > row.MaxMS {
+			row.MaxMS = entry.DurationMS
+		}
+		if row.Latest == nil || !entry.Timestamp.Before(row.Latest.Timestamp) {
+			row.Latest = entry
+		}
+	}
+	for i := len(kept); i < len(w.entries); i++ {
+		w.entries[i] = nil // Let the dropped entries be garbage collected
+	}
+	w.entries = kept
+
+	sorted := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, *row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].TotalMS != sorted[j].TotalMS {
+			return sorted[i].TotalMS > sorted[j].TotalMS
+		}
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	return sorted
+}
+
+func groupKey(grouping Grouping, item *item) string {
+	switch grouping {
+	case GROUP_COLLECTION:
+		return item.entry.Collection
+	case GROUP_USER:
+		return item.entry.User
+	case GROUP_HOST:
+		return item.entry.Host
+	default:
+		return fmt.Sprintf("%s %s", item.queryHash, item.entry.Collection)
+	}
+}
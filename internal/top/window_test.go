@@ -0,0 +1,56 @@
+package top
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/collector"
+)
+
+func TestWindowRows(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	w := NewWindow(time.Minute)
+
+	w.Add(&collector.ProfilerEntry{Timestamp: now.Add(-2 * time.Minute), Collection: "app.users", User: "api", DurationMS: 5000, QueryHash: "OLD"})
+	w.Add(&collector.ProfilerEntry{Timestamp: now.Add(-30 * time.Second), Collection: "app.users", User: "api", DurationMS: 100, QueryHash: "AAAA"})
+	w.Add(&collector.ProfilerEntry{Timestamp: now.Add(-20 * time.Second), Collection: "app.users", User: "batch", DurationMS: 300, QueryHash: "AAAA", PlanSummary: "COLLSCAN"})
+	w.Add(&collector.ProfilerEntry{Timestamp: now.Add(-10 * time.Second), Collection: "app.orders", User: "api", DurationMS: 250, QueryHash: "BBBB"})
+
+	rows := w.Rows(GROUP_SHAPE, now)
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 shapes in the window, got %+v", rows)
+	}
+	if rows[0].Key != "AAAA app.users" || rows[0].Count != 2 || rows[0].TotalMS != 400 || rows[0].MaxMS != 300 || rows[0].AvgMS() != 200 {
+		t.Errorf("unexpected first row %+v", rows[0])
+	}
+	if rows[0].Latest.PlanSummary != "COLLSCAN" {
+		t.Errorf("row should keep its latest entry, got %+v", rows[0].Latest)
+	}
+
+	rows = w.Rows(GROUP_USER, now)
+	if len(rows) != 2 || rows[0].Key != "api" || rows[0].TotalMS != 350 {
+		t.Errorf("unexpected rows by user %+v", rows)
+	}
+
+	if len(w.entries) != 3 {
+		t.Errorf("entries older than the window should be forgotten, got %v entries", len(w.entries))
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := parseKeys([]byte("\x1b[Aj\x1b[Bu\rq\x1bx"))
+	expected := []Key{KEY_UP, KEY_DOWN, KEY_DOWN, KEY_USER, KEY_ENTER, KEY_QUIT, KEY_ESCAPE}
+
+	if len(keys) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Errorf("key %v: expected %v, got %v", i, expected[i], keys[i])
+		}
+	}
+}
@@ -0,0 +1,298 @@
+"use strict";
+
+// Single page app on top of the /api routes. Values coming from the profiled databases are always set with
+// textContent, never as HTML.
+
+const PAGE_SIZE = 20;
+
+const state = {
+  sort: "total",
+  offset: 0,
+};
+
+function filters() {
+  const params = new URLSearchParams();
+  const form = document.getElementById("filters");
+  for (const input of form.querySelectorAll("input")) {
+    if (input.value.trim() !== "") {
+      params.set(input.name, input.value.trim());
+    }
+  }
+  return params;
+}
+
+async function api(path, params) {
+  const response = await fetch(`${path}?${params.toString()}`);
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+function element(tag, attributes, ...children) {
+  const el = document.createElement(tag);
+  for (const [name, value] of Object.entries(attributes || {})) {
+    el.setAttribute(name, value);
+  }
+  for (const child of children) {
+    el.append(child === null || child === undefined ? "" : child);
+  }
+  return el;
+}
+
+function number(value) {
+  if (value === null || value === undefined) {
+    return "-";
+  }
+  return value.toLocaleString();
+}
+
+function shapeLink(queryHash, collection) {
+  const params = new URLSearchParams({ collection: collection || "" });
+  return `#/shape/${encodeURIComponent(queryHash)}?${params.toString()}`;
+}
+
+function showError(container, err) {
+  container.replaceChildren(element("p", { class: "error" }, `Failed to load: ${err.message}`));
+}
+
+// Dashboard
+
+async function renderDashboard(content) {
+  content.replaceChildren(document.getElementById("dashboard").content.cloneNode(true));
+
+  for (const bars of content.querySelectorAll(".bars")) {
+    const params = filters();
+    params.set("limit", "5");
+
+    let path = "/api/shapes";
+    if (bars.classList.contains("collscans")) {
+      path = "/api/collscans";
+    } else {
+      params.set("sort", bars.dataset.sort);
+    }
+
+    api(path, params)
+      .then((page) => renderBars(bars, page.items))
+      .catch((err) => showError(bars, err));
+  }
+
+  for (const th of content.querySelectorAll("th.sortable")) {
+    th.addEventListener("click", () => {
+      state.sort = th.dataset.sort;
+      state.offset = 0;
+      renderShapes(content);
+    });
+  }
+  content.querySelector(".previous").addEventListener("click", () => {
+    state.offset = Math.max(0, state.offset - PAGE_SIZE);
+    renderShapes(content);
+  });
+  content.querySelector(".next").addEventListener("click", () => {
+    state.offset += PAGE_SIZE;
+    renderShapes(content);
+  });
+
+  await renderShapes(content);
+}
+
+function renderBars(container, items) {
+  if (items.length === 0) {
+    container.replaceChildren(element("p", { class: "empty" }, "Nothing over this period"));
+    return;
+  }
+
+  const key = container.dataset.value;
+  const max = Math.max(...items.map((item) => item[key]));
+
+  container.replaceChildren(
+    ...items.map((item) => {
+      const fill = element("div", { class: "fill" });
+      fill.style.width = `${max > 0 ? (100 * item[key]) / max : 0}%`;
+
+      return element(
+        "a",
+        { class: "bar", href: shapeLink(item.queryHash, item.collection) },
+        element("div", { class: "label" }, element("span", {}, `${item.queryHash} ${item.collection}`), element("span", {}, `${number(item[key])} ${container.dataset.unit}`)),
+        fill,
+      );
+    }),
+  );
+}
+
+async function renderShapes(content) {
+  const tbody = content.querySelector("table.shapes tbody");
+
+  for (const th of content.querySelectorAll("th.sortable")) {
+    th.classList.toggle("sorted", th.dataset.sort === state.sort);
+  }
+
+  const params = filters();
+  params.set("sort", state.sort);
+  params.set("limit", String(PAGE_SIZE));
+  params.set("offset", String(state.offset));
+
+  let page;
+  try {
+    page = await api("/api/shapes", params);
+  } catch (err) {
+    tbody.replaceChildren(element("tr", {}, element("td", { colspan: "10", class: "error" }, `Failed to load: ${err.message}`)));
+    return;
+  }
+
+  if (page.items.length === 0) {
+    tbody.replaceChildren(element("tr", {}, element("td", { colspan: "10", class: "empty" }, "No slow operation over this period")));
+  } else {
+    tbody.replaceChildren(
+      ...page.items.map((item) =>
+        element(
+          "tr",
+          {},
+          element("td", {}, element("a", { href: shapeLink(item.queryHash, item.collection) }, item.queryHash)),
+          element("td", {}, item.collection),
+          ...["count", "totalMS", "avgMS", "p50MS", "p90MS", "p99MS", "maxMS", "docsExamined"].map((key) => element("td", { class: "number" }, number(item[key]))),
+        ),
+      ),
+    );
+  }
+
+  content.querySelector(".page").textContent = `${state.offset + 1} - ${state.offset + page.items.length}`;
+  content.querySelector(".previous").disabled = state.offset === 0;
+  content.querySelector(".next").disabled = page.items.length < PAGE_SIZE;
+}
+
+// Shape detail
+
+async function renderShape(content, queryHash, collection) {
+  content.replaceChildren(document.getElementById("shape").content.cloneNode(true));
+  content.querySelector(".shape-title").textContent = `${queryHash} ${collection}`;
+
+  const params = filters();
+  params.delete("user");
+  if (collection) {
+    params.set("collection", collection);
+  }
+
+  const hash = encodeURIComponent(queryHash);
+
+  api(`/api/shapes/${hash}/timeseries`, params)
+    .then((points) => renderTimeseries(content, points))
+    .catch((err) => showError(content.querySelector(".timeseries").parentNode, err));
+
+  api(`/api/shapes/${hash}/plans`, params)
+    .then((plans) => renderPlans(content.querySelector("table.plans tbody"), plans))
+    .catch((err) => showError(content.querySelector("table.plans").parentNode, err));
+
+  api(`/api/shapes/${hash}/examples`, new URLSearchParams({ collection: collection || "" }))
+    .then((examples) => renderExamples(content.querySelector(".examples"), examples))
+    .catch((err) => showError(content.querySelector(".examples"), err));
+}
+
+function renderTimeseries(content, points) {
+  const svg = content.querySelector(".timeseries");
+  if (points.length === 0) {
+    svg.replaceWith(element("p", { class: "empty" }, "No slow operation over this period"));
+    return;
+  }
+
+  const ns = "http://www.w3.org/2000/svg";
+  const width = 1000;
+  const height = 240;
+  const start = new Date(points[0].bucket).getTime();
+  const end = new Date(points[points.length - 1].bucket).getTime();
+  const x = (point) => (end === start ? width / 2 : ((new Date(point.bucket).getTime() - start) / (end - start)) * (width - 10) + 5);
+  const maxCount = Math.max(...points.map((point) => point.count));
+  const maxDuration = Math.max(...points.map((point) => point.maxMS));
+  const y = (value) => height - (maxDuration > 0 ? (value / maxDuration) * (height - 10) : 0);
+
+  const children = [];
+  const barWidth = Math.max(1, width / points.length - 1);
+  for (const point of points) {
+    const bar = document.createElementNS(ns, "rect");
+    const barHeight = (point.count / maxCount) * (height / 3);
+    bar.setAttribute("class", "count");
+    bar.setAttribute("x", String(x(point) - barWidth / 2));
+    bar.setAttribute("y", String(height - barHeight));
+    bar.setAttribute("width", String(barWidth));
+    bar.setAttribute("height", String(barHeight));
+    const title = document.createElementNS(ns, "title");
+    title.textContent = `${new Date(point.bucket).toLocaleString()}: ${point.count} ops, avg ${point.avgMS}ms, p99 ${point.p99MS}ms, max ${point.maxMS}ms`;
+    bar.append(title);
+    children.push(bar);
+  }
+
+  for (const key of ["avgMS", "p99MS", "maxMS"]) {
+    const line = document.createElementNS(ns, "polyline");
+    line.setAttribute("class", `line ${key.replace("MS", "")}`);
+    line.setAttribute("points", points.map((point) => `${x(point)},${y(point[key])}`).join(" "));
+    children.push(line);
+  }
+
+  svg.replaceChildren(...children);
+  content.querySelector(".axis .from").textContent = new Date(start).toLocaleString();
+  content.querySelector(".axis .to").textContent = `${new Date(end).toLocaleString()} (max ${number(maxDuration)}ms)`;
+}
+
+function renderPlans(tbody, plans) {
+  if (plans.length === 0) {
+    tbody.replaceChildren(element("tr", {}, element("td", { colspan: "7", class: "empty" }, "No slow operation over this period")));
+    return;
+  }
+
+  tbody.replaceChildren(
+    ...plans.map((plan) =>
+      element(
+        "tr",
+        {},
+        element("td", {}, plan.planSummary),
+        element("td", {}, plan.planHash),
+        element("td", { class: "number" }, number(plan.count)),
+        element("td", { class: "number" }, number(plan.avgMS)),
+        element("td", { class: "number" }, number(plan.docsExamined)),
+        element("td", {}, new Date(plan.firstSeen).toLocaleString()),
+        element("td", {}, new Date(plan.lastSeen).toLocaleString()),
+      ),
+    ),
+  );
+}
+
+function renderExamples(container, examples) {
+  if (examples.length === 0) {
+    container.replaceChildren(element("p", { class: "empty" }, "No example stored"));
+    return;
+  }
+
+  container.replaceChildren(
+    ...examples.flatMap((example) => [
+      element("h4", {}, `${example.collection} (${example.planSummary || "no plan"})`),
+      element("p", {}, "Shape"),
+      element("pre", {}, JSON.stringify(example.shape, null, 2)),
+      element("p", {}, "Profile document"),
+      element("pre", {}, JSON.stringify(example.document, null, 2)),
+    ]),
+  );
+}
+
+// Routing
+
+function route() {
+  const content = document.getElementById("content");
+  const match = window.location.hash.match(/^#\/shape\/([^?]+)(?:\?(.*))?$/);
+
+  if (match) {
+    const params = new URLSearchParams(match[2] || "");
+    renderShape(content, decodeURIComponent(match[1]), params.get("collection"));
+  } else {
+    renderDashboard(content);
+  }
+}
+
+document.getElementById("filters").addEventListener("submit", (event) => {
+  event.preventDefault();
+  state.offset = 0;
+  route();
+});
+
+window.addEventListener("hashchange", route);
+route();
@@ -0,0 +1,21 @@
+// Package ui embeds the web UI served along the HTTP API, so that the profiler stays a single binary.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the UI. It only relies on the /api routes, see the api package.
+func Handler() http.Handler {
+	root, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err) // static is embedded at build time
+	}
+
+	return http.FileServer(http.FS(root))
+}
@@ -0,0 +1,23 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	handler := Handler()
+
+	for path, expected := range map[string]string{"/": "<title>Mongo Profiler</title>", "/app.js": "/api/shapes", "/style.css": "body"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("%s: unexpected response %v", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/mongo"
+	"github.com/guillotjulien/mongo-profiler/internal/report"
+)
+
+// reportCommand prints a report on the slow ops stored in the internal installation.
+func reportCommand(args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	internalURI := flags.String("internal", defaultInternalURI, "Connection string URI of internal MongoDB installation")
+	since := flags.String("since", "24h", "Start of the report, as a date (2006-01-02 or RFC 3339) or a duration before now (e.g. 24h)")
+	until := flags.String("until", "", "End of the report, as a date (2006-01-02 or RFC 3339) or a duration before now (default: now)")
+	collection := flags.String("collection", "", "Only report on this namespace (e.g. app.users)")
+	user := flags.String("user", "", "Only report on operations of this user")
+	sortBy := flags.String("sort", "", "Column to sort on, depends on the report (default: total duration)")
+	limit := flags.Int("limit", 10, "Number of rows")
+	offset := flags.Int("offset", 0, "Number of rows to skip")
+	format := flags.String("format", report.FORMAT_TABLE, "Output format: table, json or csv")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mongo-profiler report [flags] <report>\n\nReports:\n")
+
+		names := report.Names()
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			fmt.Fprintf(flags.Output(), "  %-12s %s\n", name, names[name])
+		}
+
+		fmt.Fprintf(flags.Output(), "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	opts := report.Options{Collection: *collection, User: *user, Sort: *sortBy, Limit: *limit, Offset: *offset}
+
+	var err error
+	if opts.Since, err = report.ParseTime(*since); err != nil {
+		logger.Fatal("invalid -since: %v", err)
+	}
+	if *until != "" {
+		if opts.Until, err = report.ParseTime(*until); err != nil {
+			logger.Fatal("invalid -until: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	internalClient, err := mongo.NewClient(ctx, *internalURI)
+	if err != nil {
+		logger.Fatal("failed to instantiate internal client: %v", err)
+	}
+
+	if err := internalClient.Connect(ctx); err != nil {
+		logger.Fatal("failed to connect to internal MongoDB installation: %v", err)
+	}
+	defer internalClient.Disconnect(ctx)
+
+	result, err := report.Run(ctx, internalClient.GetDefaultDatabase(), flags.Arg(0), opts)
+	if err != nil {
+		logger.Fatal("failed to run report %s: %v", flags.Arg(0), err)
+	}
+
+	if err := report.Write(os.Stdout, result, *format); err != nil {
+		logger.Fatal("%v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/guillotjulien/mongo-profiler/internal/api"
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/mongo"
+	"github.com/guillotjulien/mongo-profiler/internal/ui"
+)
+
+// serveCommand serves the web UI and the API over the slow ops stored in the internal installation.
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	internalURI := flags.String("internal", defaultInternalURI, "Connection string URI of internal MongoDB installation")
+	listen := flags.String("listen", constant.SERVER_LISTEN_ADDRESS, "Address the HTTP server listens on")
+	verbose := flags.Bool("v", false, "Make the server more talkative")
+
+	flags.Parse(args)
+
+	if *verbose {
+		logger.VERBOSE_LOGS = true
+	}
+
+	ctx := context.Background()
+	internalClient, err := mongo.NewClient(ctx, *internalURI)
+	if err != nil {
+		logger.Fatal("failed to instantiate internal client: %v", err)
+	}
+
+	if err := internalClient.Connect(ctx); err != nil {
+		logger.Fatal("failed to connect to internal MongoDB installation: %v", err)
+	}
+
+	handler := api.NewServer(internalClient.GetDefaultDatabase())
+	handler.Handle("/", ui.Handler())
+
+	server := &http.Server{Addr: *listen, Handler: handler}
+
+	teardownComplete := make(chan bool, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		<-signals // Wait for signal
+
+		logger.Info("received shutdown signal. Stopping server")
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, constant.SERVER_SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to stop server gracefully: %v", err)
+		}
+
+		if err := internalClient.Disconnect(shutdownCtx); err != nil {
+			logger.Warn("failed to close connection with internal MongoDB installation: %v", err)
+		}
+
+		teardownComplete <- true
+	}()
+
+	logger.Info("listening on %s", *listen)
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal("%v", err)
+	}
+
+	<-teardownComplete // wait for teardown
+}
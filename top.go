@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/guillotjulien/mongo-profiler/internal/collector"
+	"github.com/guillotjulien/mongo-profiler/internal/constant"
+	"github.com/guillotjulien/mongo-profiler/internal/logger"
+	"github.com/guillotjulien/mongo-profiler/internal/mongo"
+	"github.com/guillotjulien/mongo-profiler/internal/top"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// topCommand shows the slow ops of the listened installation as they happen, without storing them.
+func topCommand(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	listenedURI := flags.String("listened", "", "Connection string URI of listened MongoDB installation")
+	slowThresholdMS := flags.Uint64("slowThresholdMS", 100, "Define the minimum query duration in milliseconds after which a query will be logged")
+	profilerLevel := flags.Uint("profilerLevel", 1, "Set MongoDB profiler level. 1 only logs slow queries, 2 logs all queries")
+	databases := flags.String("databases", "", "Comma separated list of databases to profile, or * for every non-system database (default: database of the listened URI)")
+	allMembers := flags.Bool("allMembers", false, "Profile every member of the replica set (e.g. to catch reads sent to secondaries) instead of the primary only")
+	span := flags.Duration("window", constant.TOP_WINDOW, "Operations of this last period are ranked")
+	refresh := flags.Duration("refresh", constant.TOP_REFRESH_INTERVAL, "Time between two refreshes of the screen")
+	logFile := flags.String("log", "", "File receiving the logs, which are discarded otherwise as they would garble the screen")
+
+	flags.Parse(args)
+
+	if *listenedURI == "" {
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listenedClient, err := mongo.NewClient(ctx, *listenedURI)
+	if err != nil {
+		logger.Fatal("failed to instantiate listened client: %v", err)
+	}
+
+	var logs io.Writer = io.Discard
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			logger.Fatal("failed to open log file: %v", err)
+		}
+		defer f.Close()
+		logs = f
+	}
+
+	terminal, err := top.OpenTerminal()
+	if err != nil {
+		logger.Fatal("%v", err)
+	}
+	log.SetOutput(logs)
+
+	window := top.NewWindow(*span)
+
+	c := collector.NewCollector(listenedClient, collector.CollectorOptions{
+		SlowThresholdMS: *slowThresholdMS,
+		ProfilerLevel:   *profilerLevel,
+		AllMembers:      *allMembers,
+		Databases:       splitList(*databases),
+		Workers:         2,
+		QueueSize:       constant.TOP_MAX_ENTRIES,
+		QueuePolicy:     collector.QueueDropOldest, // Never slow down the tailers, the screen only shows aggregates
+	})
+
+	collectorDone := make(chan error, 1)
+	go func() {
+		collectorDone <- c.Start(ctx, func(ctx context.Context, source collector.Source, data bson.Raw) error {
+			if source.Host == "" {
+				source.Host = strings.Join(listenedClient.Connstr.Hosts, ",")
+			}
+
+			entry, err := collector.NewProfilerEntry(source, data)
+			if err != nil {
+				return err
+			}
+
+			window.Add(entry)
+
+			return nil
+		})
+	}()
+
+	keys := make(chan top.Key)
+	go top.ReadKeys(os.Stdin, keys)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+
+	view := top.View{Grouping: top.GROUP_SHAPE}
+
+loop:
+	for {
+		rows := window.Rows(view.Grouping, time.Now())
+		view.Height, view.Width = terminal.Size()
+
+		visible := view.Height - 5 // Header, column names and status lines
+		if visible > len(rows) {
+			visible = len(rows)
+		}
+		if view.Selected >= visible {
+			view.Selected = visible - 1
+		}
+		if view.Selected < 0 {
+			view.Selected = 0
+		}
+
+		top.Render(os.Stdout, view, rows, window.Span(), time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-signals:
+			break loop
+		case err := <-collectorDone:
+			view.Status = "collector stopped"
+			if err != nil {
+				view.Status = fmt.Sprintf("collector stopped: %v", err)
+			}
+			collectorDone = nil
+		case key, ok := <-keys:
+			if !ok {
+				break loop
+			}
+
+			switch key {
+			case top.KEY_QUIT:
+				break loop
+			case top.KEY_UP:
+				view.Selected--
+			case top.KEY_DOWN:
+				view.Selected++
+			case top.KEY_ENTER:
+				view.Detail = !view.Detail
+			case top.KEY_ESCAPE:
+				view.Detail = false
+			case top.KEY_SHAPE, top.KEY_COLLECTION, top.KEY_USER, top.KEY_HOST:
+				view.Grouping = map[top.Key]top.Grouping{
+					top.KEY_SHAPE:      top.GROUP_SHAPE,
+					top.KEY_COLLECTION: top.GROUP_COLLECTION,
+					top.KEY_USER:       top.GROUP_USER,
+					top.KEY_HOST:       top.GROUP_HOST,
+				}[key]
+				view.Selected = 0
+				view.Detail = false
+			}
+		}
+	}
+
+	if err := terminal.Close(); err != nil {
+		logger.Warn("failed to restore terminal: %v", err)
+	}
+	log.SetOutput(os.Stderr)
+
+	logger.Info("stopping collector, restoring profiler settings")
+
+	// Put the profiler settings back as they were
+	if err := c.Stop(ctx); err != nil {
+		logger.Fatal("failed to stop collector: %v", err)
+	}
+}